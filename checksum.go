@@ -0,0 +1,71 @@
+package ttlru
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// ErrChecksum is returned by TryGet when a []byte value no longer matches the
+// checksum taken when it was set
+var ErrChecksum = errors.New("ttlru: value does not match its checksum")
+
+// WithChecksum takes a checksum of every []byte value when it is set, and
+// verifies it whenever the value is read, to detect values corrupted while
+// cached. Corrupted values are removed, and read as misses, or reported by
+// TryGet with ErrChecksum. Values of other types are not checked.
+func WithChecksum() Option {
+	return func(c *cache) error {
+		if c.running {
+			return errRunning("WithChecksum")
+		}
+		c.checksum = true
+		return nil
+	}
+}
+
+// sum takes the checksum of the value of e
+func (c *cache) sum(e *entry) {
+	// must already have a write lock
+
+	if !c.checksum {
+		return
+	}
+
+	if b, ok := e.value.([]byte); ok {
+		e.sum = crc32.ChecksumIEEE(b)
+	}
+}
+
+// corrupt reports whether the value of e does not match its checksum
+func (c *cache) corrupt(e *entry) bool {
+	if !c.checksum {
+		return false
+	}
+
+	b, ok := e.value.([]byte)
+	return ok && crc32.ChecksumIEEE(b) != e.sum
+}
+
+func (c *cache) TryGet(key interface{}) (interface{}, bool, error) {
+	return c.tryGet(key, false)
+}
+
+func (c *cache) tryGet(key interface{}, view bool) (interface{}, bool, error) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if ent, ok := c.items[key]; ok && c.corrupt(ent) {
+		c.removeEntry(ent)
+		return nil, false, ErrChecksum
+	}
+
+	if ent := c.access(key, !c.NoReset, view); ent != nil {
+		value, err := c.decodeValue(ent.value)
+		if err != nil {
+			return nil, false, err
+		}
+		return value, true, nil
+	}
+
+	return nil, false, nil
+}
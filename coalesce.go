@@ -0,0 +1,104 @@
+package ttlru
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithTimerGranularity expires entries on shared timers, one for each val
+// interval in which entries are due to expire, rather than arming a timer for
+// every entry. Entries expire up to val after their TTL elapses, but are no
+// longer returned once it has.
+func WithTimerGranularity(val time.Duration) Option {
+	return func(c *cache) error {
+		if val < 0 {
+			return fmt.Errorf("ttlru: negative timer granularity %v", val)
+		}
+		if c.running {
+			return errRunning("WithTimerGranularity")
+		}
+		c.granularity = val
+		return nil
+	}
+}
+
+// tick is a timer shared by the entries expiring in an interval
+type tick struct {
+	n       int64
+	timer   *time.Timer
+	entries map[*entry]struct{}
+}
+
+// armTick adds e to the tick for the interval that d from now falls in
+func (c *cache) armTick(e *entry, d time.Duration) {
+	// must already have a write lock
+
+	g := int64(c.granularity)
+	n := (time.Now().Add(d).UnixNano() + g - 1) / g
+
+	if e.tick != nil && e.tick.n == n {
+		return
+	}
+
+	c.disarmTick(e)
+
+	t, ok := c.ticks[n]
+	if !ok {
+		if c.ticks == nil {
+			c.ticks = map[int64]*tick{}
+		}
+
+		t = &tick{n: n, entries: map[*entry]struct{}{}}
+		t.timer = time.AfterFunc(time.Until(time.Unix(0, n*g)), func() {
+			c.do("expire", func() {
+				c.fireTick(t)
+			})
+		})
+		c.ticks[n] = t
+	}
+
+	t.entries[e] = struct{}{}
+	e.tick = t
+}
+
+// disarmTick removes e from its tick, stopping the tick if it is no longer
+// needed
+func (c *cache) disarmTick(e *entry) {
+	// must already have a write lock
+
+	t := e.tick
+	if t == nil {
+		return
+	}
+
+	e.tick = nil
+	delete(t.entries, e)
+
+	if len(t.entries) == 0 {
+		t.timer.Stop()
+		delete(c.ticks, t.n)
+	}
+}
+
+func (c *cache) fireTick(t *tick) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	// the entries of the tick may all have been disarmed while it waited for
+	// the lock, and a new tick made for the same interval
+	if c.ticks[t.n] == t {
+		delete(c.ticks, t.n)
+	}
+
+	now := c.clock()
+	for e := range t.entries {
+		e.tick = nil
+
+		// as with the timer of a single entry
+		if c.items[e.key] != e || now.Before(e.expires) || e.leased() {
+			continue
+		}
+
+		c.expireEntry(e)
+	}
+}
@@ -0,0 +1,149 @@
+package ttlru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config holds the settings of a cache that WatchConfig can change while it is
+// in use
+type Config struct {
+	// TTL is the default TTL of items, zero meaning they never expire
+	TTL time.Duration
+
+	// Cap is the number of items the cache can retain. Zero keeps the current
+	// capacity.
+	Cap int
+
+	// NoReset stops accesses from resetting the TTL of items, as WithoutReset
+	// does
+	NoReset bool
+}
+
+// ConfigEvent reports the outcome of applying a Config
+type ConfigEvent struct {
+	Config Config
+
+	// Evicted holds the items that were evicted because the new settings
+	// reduced the capacity of the cache
+	Evicted []Entry
+
+	// Err is set, and the cache left unchanged, if the Config was invalid
+	Err error
+}
+
+// WithCap changes the number of items the cache can retain. It is mostly
+// useful with Configure, as New is given the capacity directly.
+func WithCap(cap int) Option {
+	return func(c *cache) error {
+		if cap <= 0 {
+			return fmt.Errorf("ttlru: capacity %d is not positive", cap)
+		}
+		c.cap = cap
+		return nil
+	}
+}
+
+// WatchConfig applies every Config received from configs to c, calling fn, if
+// not nil, with the outcome of each. c must have been created by New. It
+// returns when configs is closed, or with the error of ctx when it is done.
+func WatchConfig(ctx context.Context, c Cache, configs <-chan Config, fn func(ConfigEvent)) error {
+	cc, ok := c.(*cache)
+	if !ok {
+		return errors.New("ttlru: WatchConfig requires a cache created by New")
+	}
+
+	for {
+		var cfg Config
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case cfg, ok = <-configs:
+			if !ok {
+				return nil
+			}
+		}
+
+		opts := []Option{
+			WithTTL(cfg.TTL),
+			func(c *cache) error {
+				c.NoReset = cfg.NoReset
+				return nil
+			},
+		}
+
+		if cfg.Cap != 0 {
+			opts = append(opts, WithCap(cfg.Cap))
+		}
+
+		evicted, err := cc.configure(opts)
+		if fn != nil {
+			fn(ConfigEvent{Config: cfg, Evicted: evicted, Err: err})
+		}
+	}
+}
+
+func errRunning(option string) error {
+	return fmt.Errorf("ttlru: %s can not be changed after the cache is created", option)
+}
+
+func (c *cache) Configure(opts ...Option) error {
+	_, err := c.configure(opts)
+	return err
+}
+
+// configure applies opts and returns the items evicted as a result
+func (c *cache) configure(opts []Option) ([]Entry, error) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	// try the options on a scratch cache first, so that an invalid one leaves
+	// the cache unchanged
+	scratch := cache{
+		cap:         c.cap,
+		maxCost:     c.maxCost,
+		costFunc:    c.costFunc,
+		protectSize: c.protectSize,
+		running:     true,
+	}
+
+	for _, opt := range opts {
+		if err := opt(&scratch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := scratch.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		_ = opt(c)
+	}
+
+	// the cost function, or the budget, may have changed
+	if c.maxCost > 0 {
+		c.cost = 0
+		c.costs = [costBuckets]uint64{}
+		for _, e := range c.items {
+			e.cost = c.entryCost(e.key, e.value)
+			c.addCost(e)
+		}
+	}
+
+	var evicted []Entry
+	for c.overCapacity() {
+		ent := c.victim(nil)
+		if ent == nil {
+			break
+		}
+
+		evicted = append(evicted, c.export(ent))
+		c.spillEntry(ent)
+		c.evictEntry(ent)
+	}
+
+	return evicted, nil
+}
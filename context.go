@@ -0,0 +1,42 @@
+package ttlru
+
+import (
+	"context"
+	"errors"
+)
+
+// contextKey is the key a cache is attached to a context with
+type contextKey struct{}
+
+// NewContextCache creates a cache with cap entries and opts, as NewWithError
+// does, and returns a copy of ctx that carries it. Once ctx is done the cache
+// is purged, stopping the timers of its entries, and closed. Watching ctx
+// takes a goroutine, so the cache can not be WithoutTimers.
+func NewContextCache(ctx context.Context, cap int, opts ...Option) (context.Context, Cache, error) {
+	l, err := NewWithError(cap, opts...)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	c := l.(*cache)
+	if c.lazy {
+		return ctx, nil, errors.New("ttlru: NewContextCache can not be used WithoutTimers")
+	}
+
+	go c.do("context", func() {
+		select {
+		case <-ctx.Done():
+			c.Purge()
+			c.Close()
+		case <-c.done:
+		}
+	})
+
+	return context.WithValue(ctx, contextKey{}, l), l, nil
+}
+
+// FromContext returns the cache attached to ctx by NewContextCache, if any
+func FromContext(ctx context.Context) (Cache, bool) {
+	l, ok := ctx.Value(contextKey{}).(Cache)
+	return l, ok
+}
@@ -0,0 +1,60 @@
+package ttlru
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithLoadCooldown starts a cooldown of interval for a key each time it is
+// removed with Del. While a key is cooling down, Fetch and the functions
+// memoized over the cache call through to their backend for it at most once
+// per interval; other misses get the result of the last call, so invalidation
+// storms do not become load spikes.
+func WithLoadCooldown(interval time.Duration) Option {
+	return func(c *cache) error {
+		if interval <= 0 {
+			return fmt.Errorf("ttlru: load cooldown %v is not positive", interval)
+		}
+		c.loadCooldown = interval
+		return nil
+	}
+}
+
+// cool starts the load cooldown of key
+func (c *cache) cool(key interface{}) {
+	// must already have a write lock
+
+	if c.loadCooldown <= 0 {
+		return
+	}
+
+	if c.cooling == nil {
+		c.cooling = map[interface{}]time.Time{}
+	}
+
+	if _, ok := c.cooling[key]; !ok {
+		c.coolingKeys = append(c.coolingKeys, key)
+	}
+	c.cooling[key] = time.Now()
+
+	// forget the oldest cooldowns, like tombstones
+	for len(c.cooling) > c.cap {
+		delete(c.cooling, c.coolingKeys[0])
+		c.coolingKeys = c.coolingKeys[1:]
+	}
+}
+
+// cooldown returns the load cooldown interval and the capacity of the cache,
+// both of which Configure may change, and whether key was deleted within the
+// interval
+func (c *cache) cooldown(key interface{}) (time.Duration, int, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.loadCooldown <= 0 {
+		return 0, c.cap, false
+	}
+
+	since, ok := c.cooling[key]
+	return c.loadCooldown, c.cap, ok && time.Since(since) < c.loadCooldown
+}
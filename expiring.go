@@ -0,0 +1,46 @@
+package ttlru
+
+import (
+	"sort"
+	"time"
+)
+
+func (c *cache) ExpiringWithin(d time.Duration) []Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := c.clock()
+	horizon := now.Add(d)
+
+	var ents []*entry
+	for _, h := range c.heaps() {
+		ents = expiringIn(*h, 0, now, horizon, ents)
+	}
+
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].expires.Before(ents[j].expires)
+	})
+
+	entries := make([]Entry, len(ents))
+	for i, e := range ents {
+		entries[i] = c.export(e)
+	}
+
+	return entries
+}
+
+// expiringIn appends the live entries of the subtree of h rooted at i that
+// expire before horizon to ents. Subtrees rooted at an entry expiring later
+// are skipped, as nothing below it can expire sooner.
+func expiringIn(h ttlHeap, i int, now, horizon time.Time, ents []*entry) []*entry {
+	if i >= len(h) || !h[i].expires.Before(horizon) {
+		return ents
+	}
+
+	if e := h[i]; e.ttl > 0 && e.live(now) {
+		ents = append(ents, e)
+	}
+
+	ents = expiringIn(h, 2*i+1, now, horizon, ents)
+	return expiringIn(h, 2*i+2, now, horizon, ents)
+}
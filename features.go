@@ -0,0 +1,11 @@
+package ttlru
+
+// TimersSupported reports whether caches expire items with timers in this
+// build. When it is false, as when built with TinyGo or the ttlru_notimers
+// tag, every cache behaves as if created WithoutTimers.
+const TimersSupported = !notimers
+
+// MemoryLimitSheddingSupported reports whether WithMemoryLimitShedding can be
+// used in this build. It is false when built with TinyGo, which does not
+// provide the runtime metrics it relies on.
+const MemoryLimitSheddingSupported = memoryMetrics
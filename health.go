@@ -0,0 +1,84 @@
+package ttlru
+
+import "fmt"
+
+// Consistency describes how well the internal structures of a cache agree
+// with one another, for use in health checks
+type Consistency struct {
+	// MapLen is the number of items in the key map
+	MapLen int
+
+	// HeapLen is the number of items in the expiration heaps
+	HeapLen int
+
+	// Timers is the number of items with an expiration timer
+	Timers int
+
+	// Problems describes each disagreement found. It is empty for a healthy
+	// cache.
+	Problems []string
+}
+
+func (c *cache) HeapDepth() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.heapLen()
+}
+
+// heapLen returns the number of entries in all the heaps
+func (c *cache) heapLen() int {
+	// must already have a read lock
+
+	var n int
+	for _, h := range c.heaps() {
+		n += h.Len()
+	}
+	return n
+}
+
+func (c *cache) MapLen() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.items)
+}
+
+func (c *cache) ConsistencyReport() Consistency {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	r := Consistency{
+		MapLen:  len(c.items),
+		HeapLen: c.heapLen(),
+	}
+
+	if r.MapLen != r.HeapLen {
+		r.Problems = append(r.Problems, fmt.Sprintf("%d items in the map, but %d in the heaps", r.MapLen, r.HeapLen))
+	}
+
+	for _, h := range c.heaps() {
+		for i, e := range *h {
+			if e.index != i || e.heap != h {
+				r.Problems = append(r.Problems, fmt.Sprintf("item %v is at %d in its heap, but indexed at %d", e.key, i, e.index))
+			}
+			if c.items[e.key] != e {
+				r.Problems = append(r.Problems, fmt.Sprintf("item %v is in a heap, but not the map", e.key))
+			}
+		}
+	}
+
+	// timers are only armed for items that expire, and not while paused or
+	// WithoutTimers. Leased items that were due to expire are expired when
+	// released instead.
+	wantTimers := !c.lazy && !c.paused()
+	for _, e := range c.items {
+		armed := wantTimers && (e.tick != nil || e.timer != nil)
+		if armed {
+			r.Timers++
+		}
+		if wantTimers && e.ttl > 0 && !armed && !e.leased() {
+			r.Problems = append(r.Problems, fmt.Sprintf("item %v expires, but has no timer", e.key))
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,114 @@
+// Package idempotency tracks idempotency keys, such as those sent with HTTP
+// requests, so that a request repeated by a client is only processed once and
+// the repeats are answered with the response to the first.
+package idempotency // import "zvelo.io/ttlru/idempotency"
+
+import (
+	"sync"
+	"time"
+
+	"zvelo.io/ttlru"
+)
+
+// State is the state of an idempotency key
+type State int
+
+const (
+	// Unknown keys have not been reserved, or have expired
+	Unknown State = iota
+
+	// InFlight keys have been reserved by a request that has not yet
+	// completed
+	InFlight
+
+	// Completed keys have a response
+	Completed
+)
+
+// record is the value held in the cache for each key
+type record struct {
+	state    State
+	response interface{}
+}
+
+// Store holds idempotency keys for ttl after they are reserved, and again
+// after they are completed
+type Store struct {
+	cache ttlru.Cache
+
+	// makes each change of state atomic
+	lock sync.Mutex
+}
+
+// New creates a Store holding up to cap keys. When it is full, reserving a
+// key forgets the one closest to expiring. It returns nil if cap is not
+// positive or ttl is negative.
+func New(cap int, ttl time.Duration) *Store {
+	c := ttlru.New(cap, ttlru.WithTTL(ttl), ttlru.WithoutReset())
+	if c == nil {
+		return nil
+	}
+
+	return &Store{cache: c}
+}
+
+// Reserve marks key as in flight. It returns true if the key was unknown, in
+// which case the caller should process the request and then call Complete
+// or Cancel. Otherwise the request is a repeat and Lookup describes it.
+func (s *Store) Reserve(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.cache.Get(key); ok {
+		return false
+	}
+
+	s.cache.Set(key, record{state: InFlight})
+	return true
+}
+
+// Complete stores the response to the request that reserved key. It returns
+// false, and stores nothing, if key is not in flight, such as when its
+// reservation expired.
+func (s *Store) Complete(key string, response interface{}) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state(key) != InFlight {
+		return false
+	}
+
+	s.cache.Set(key, record{state: Completed, response: response})
+	return true
+}
+
+// Cancel forgets the reservation of key, if it is in flight, so that the
+// request may be retried. It returns false if key was not in flight.
+func (s *Store) Cancel(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state(key) != InFlight {
+		return false
+	}
+
+	return s.cache.Del(key)
+}
+
+// Lookup returns the state of key and, if it is completed, its response
+func (s *Store) Lookup(key string) (State, interface{}) {
+	value, ok := s.cache.Get(key)
+	if !ok {
+		return Unknown, nil
+	}
+
+	r := value.(record)
+	return r.state, r.response
+}
+
+func (s *Store) state(key string) State {
+	// must already hold the lock
+
+	state, _ := s.Lookup(key)
+	return state
+}
@@ -0,0 +1,66 @@
+package idempotency
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	require.Nil(t, New(0, time.Second))
+
+	s := New(2, 50*time.Millisecond)
+	require.NotNil(t, s)
+
+	state, _ := s.Lookup("a")
+	require.Equal(t, Unknown, state)
+	require.False(t, s.Complete("a", "early"))
+
+	require.True(t, s.Reserve("a"))
+	require.False(t, s.Reserve("a"))
+	state, _ = s.Lookup("a")
+	require.Equal(t, InFlight, state)
+
+	require.True(t, s.Complete("a", "response"))
+	require.False(t, s.Complete("a", "again"))
+	require.False(t, s.Reserve("a"))
+	state, response := s.Lookup("a")
+	require.Equal(t, Completed, state)
+	require.Equal(t, "response", response)
+
+	// cancelled reservations may be retried
+	require.True(t, s.Reserve("b"))
+	require.True(t, s.Cancel("b"))
+	require.False(t, s.Cancel("b"))
+	require.True(t, s.Reserve("b"))
+
+	// as may expired ones
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, s.Complete("b", "late"))
+	require.True(t, s.Reserve("b"))
+	state, _ = s.Lookup("a")
+	require.Equal(t, Unknown, state)
+}
+
+func TestReserveConcurrent(t *testing.T) {
+	s := New(1, time.Minute)
+	require.NotNil(t, s)
+
+	var first int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.Reserve("a") {
+				atomic.AddInt32(&first, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), first)
+}
@@ -0,0 +1,15 @@
+package ttlru
+
+// WithName names the cache. The name is attached, along with the kind of work,
+// as pprof labels to the background work of the cache, such as expiring
+// entries and watching memory, so that profiles and goroutine dumps can be
+// attributed to it.
+func WithName(name string) Option {
+	return func(c *cache) error {
+		if c.running {
+			return errRunning("WithName")
+		}
+		c.name = name
+		return nil
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !tinygo
+// +build !tinygo
+
+package ttlru
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// do runs fn with pprof labels identifying the cache and task
+func (c *cache) do(task string, fn func()) {
+	labels := pprof.Labels("ttlru.cache", c.name, "ttlru.task", task)
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		fn()
+	})
+}
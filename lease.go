@@ -0,0 +1,162 @@
+package ttlru
+
+import (
+	"reflect"
+	"sync"
+)
+
+// ref counts the leases on a value of an entry
+type ref struct {
+	entry *entry
+	value interface{}
+	count int
+
+	// dropped is set once the value is no longer held by the cache
+	dropped bool
+}
+
+// WithLeaseRefresh resets the TTL of an item when a lease on it, taken with
+// Acquire, is released
+func WithLeaseRefresh() Option {
+	return func(c *cache) error {
+		c.leaseRefresh = true
+		return nil
+	}
+}
+
+// WithDestructor calls fn with every value that is no longer held by the
+// cache, because it was replaced, deleted, purged, evicted or expired, once
+// all the leases taken on it with Acquire have been released. This makes it
+// safe to cache values holding resources that must be freed. fn is called
+// without holding any lock on the cache, so it may use the cache itself.
+func WithDestructor(fn func(key, value interface{})) Option {
+	return func(c *cache) error {
+		c.destructor = fn
+		return nil
+	}
+}
+
+func (c *cache) Acquire(key interface{}) (interface{}, func(), bool) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent, ok := c.items[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	value, err := c.decodeValue(ent.value)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	if ent.ref == nil {
+		ent.ref = &ref{entry: ent, value: ent.value}
+	}
+
+	// lease the value before accessing it, as the access may remove the entry
+	// and would then destroy the value if it were not leased
+	r := ent.ref
+	r.count++
+
+	if c.access(key, !c.NoReset, false) != ent {
+		r.count--
+		if r.dropped && r.count == 0 {
+			c.destroy(ent.key, r.value)
+		}
+		return nil, nil, false
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.release(r)
+		})
+	}
+
+	return value, release, true
+}
+
+func (c *cache) release(r *ref) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.leaseRefresh && !r.dropped {
+		c.resetEntryTTL(r.entry)
+	}
+
+	c.unref(r)
+}
+
+// unlease releases a lease taken other than by Acquire, which does not
+// refresh the TTL of the item
+func (c *cache) unlease(r *ref) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	c.unref(r)
+}
+
+// unref removes a lease on r, doing whatever was put off while it was leased
+func (c *cache) unref(r *ref) {
+	// must already have a write lock
+
+	r.count--
+
+	e := r.entry
+
+	if r.dropped {
+		// replaced, deleted or purged while leased
+		if r.count == 0 {
+			c.destroy(e.key, r.value)
+		}
+		return
+	}
+
+	if r.count > 0 {
+		return
+	}
+
+	if e.dead(c.clock()) {
+		c.expireEntry(e)
+		return
+	}
+
+	// the cache may have filled up with leased items
+	c.evict(nil)
+}
+
+// dropValue releases the current value of e from the cache, destroying it
+// unless it is still leased
+func (c *cache) dropValue(e *entry) {
+	// must already have a write lock
+
+	if r := e.ref; r != nil {
+		e.ref = nil
+		r.dropped = true
+
+		if r.count > 0 {
+			return
+		}
+	}
+
+	c.destroy(e.key, e.value)
+}
+
+func (c *cache) destroy(key, value interface{}) {
+	// must already have a write lock
+
+	if c.destructor != nil {
+		c.destroyed = append(c.destroyed, Entry{Key: key, Value: value})
+	}
+}
+
+// sameValue reports whether a and b are the same value, without panicking on
+// values that are not comparable
+func sameValue(a, b interface{}) bool {
+	t := reflect.TypeOf(a)
+	if t == nil || t != reflect.TypeOf(b) || !t.Comparable() {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,65 @@
+package ttlru
+
+import "sync"
+
+func (c *cache) WithLockedValue(key interface{}, fn func(value *interface{})) bool {
+	return c.withLockedValue(key, fn, false)
+}
+
+func (c *cache) withLockedValue(key interface{}, fn func(value *interface{}), view bool) bool {
+	c.lock.Lock()
+	ent := c.access(key, !c.NoReset, view)
+	if ent == nil {
+		c.lock.Unlock()
+		return false
+	}
+
+	if ent.mu == nil {
+		ent.mu = &sync.Mutex{}
+	}
+	mu := ent.mu
+	c.unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// read the value only once holding the item lock, so that it includes the
+	// changes made by any previous call. It is leased while fn runs, so that
+	// it is not destroyed should the item be removed in the meantime.
+	c.lock.Lock()
+	if c.items[key] != ent {
+		c.unlock()
+		return false
+	}
+
+	if ent.ref == nil {
+		ent.ref = &ref{entry: ent, value: ent.value}
+	}
+	r := ent.ref
+	r.count++
+	value, version := ent.value, ent.version
+	c.unlock()
+
+	defer c.unlease(r)
+
+	value, err := c.decodeValue(value)
+	if err != nil {
+		return false
+	}
+
+	orig := value
+	fn(&value)
+
+	if sameValue(orig, value) {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.items[key] == ent && ent.version == version {
+		c.store(key, value, nil)
+	}
+
+	return true
+}
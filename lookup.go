@@ -0,0 +1,48 @@
+package ttlru
+
+import "time"
+
+// Result describes the outcome of looking up a single key with Lookup
+type Result struct {
+	Key   interface{}
+	Value interface{}
+
+	// Found is whether the key has a live value
+	Found bool
+
+	// Stale is whether the key has a value whose TTL has elapsed, but which
+	// has not been removed yet. The value is returned, but Found is false.
+	Stale bool
+
+	// TTL is the time remaining until a found value expires, or zero if it
+	// never does
+	TTL time.Duration
+}
+
+func (c *cache) Lookup(keys []interface{}) []Result {
+	return c.lookupKeys(keys, false)
+}
+
+func (c *cache) lookupKeys(keys []interface{}, view bool) []Result {
+	c.lock.Lock()
+	defer c.unlock()
+
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		r := &results[i]
+		r.Key = key
+
+		if ent := c.access(key, !c.NoReset, view); ent != nil {
+			if r.Value, r.Found = c.plain(ent.value); r.Found && ent.ttl > 0 {
+				r.TTL = ent.expires.Sub(c.clock())
+			}
+			continue
+		}
+
+		if ent, ok := c.items[key]; ok && ent.dead(c.clock()) {
+			r.Value, r.Stale = c.plain(ent.value)
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,62 @@
+package ttlru
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// WithMemoryLimitShedding starts a watcher that checks the memory used by the
+// process every interval. When it exceeds threshold, a fraction between 0 and
+// 1, of the limit set by GOMEMLIMIT, fraction of the entries in the cache are
+// evicted, soonest expiring first. Nothing is shed if no memory limit is set.
+// The watcher runs until Close is called.
+func WithMemoryLimitShedding(threshold, fraction float64, interval time.Duration) Option {
+	return func(c *cache) error {
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("ttlru: memory threshold %v is not in (0, 1]", threshold)
+		}
+		if fraction <= 0 || fraction > 1 {
+			return fmt.Errorf("ttlru: shed fraction %v is not in (0, 1]", fraction)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("ttlru: memory watch interval %v is not positive", interval)
+		}
+		if c.running {
+			return errRunning("WithMemoryLimitShedding")
+		}
+		if !MemoryLimitSheddingSupported {
+			return errors.New("ttlru: WithMemoryLimitShedding is not supported by this build")
+		}
+		c.shedThreshold = threshold
+		c.shedFraction = fraction
+		c.shedInterval = interval
+		return nil
+	}
+}
+
+// shed evicts entries if used is above the threshold of limit
+func (c *cache) shed(used, limit uint64) {
+	if limit == 0 || limit >= math.MaxInt64 {
+		// no memory limit is set
+		return
+	}
+
+	if float64(used) < c.shedThreshold*float64(limit) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	n := int(math.Ceil(float64(len(c.items)) * c.shedFraction))
+	for i := 0; i < n; i++ {
+		ent := c.victim(nil)
+		if ent == nil {
+			break
+		}
+
+		c.evictEntry(ent)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !tinygo
+// +build !tinygo
+
+package ttlru
+
+import (
+	"runtime/metrics"
+	"time"
+)
+
+// the memory limit and usage are read from runtime/metrics
+const memoryMetrics = true
+
+func (c *cache) watchMemory() {
+	ticker := time.NewTicker(c.shedInterval)
+	defer ticker.Stop()
+
+	samples := []metrics.Sample{
+		{Name: "/gc/gomemlimit:bytes"},
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		metrics.Read(samples)
+
+		ok := true
+		for _, s := range samples {
+			ok = ok && s.Value.Kind() == metrics.KindUint64
+		}
+
+		if !ok {
+			// the metrics are not supported by this runtime
+			return
+		}
+
+		limit := samples[0].Value.Uint64()
+		used := samples[1].Value.Uint64() - samples[2].Value.Uint64()
+
+		c.shed(used, limit)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build tinygo
+// +build tinygo
+
+package ttlru
+
+// TinyGo does not provide runtime/metrics to read the memory limit from
+const memoryMetrics = false
+
+func (c *cache) watchMemory() {}
@@ -0,0 +1,211 @@
+package ttlru
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLoadTimeout is returned to a caller of a memoized function whose context
+// was done while it waited on an invocation, whether started by it or by
+// another caller
+var ErrLoadTimeout = errors.New("ttlru: context done while waiting for load")
+
+// ErrLoadPanic is returned to the callers of a memoized function, or Fetch,
+// that waited on an invocation that panicked. The caller that made the
+// invocation gets the panic, if it is still waiting.
+var ErrLoadPanic = errors.New("ttlru: load panicked")
+
+// call is an in-flight, or completed, invocation of a memoized function
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+	at    time.Time
+
+	// panicked is set, with the recovered value, if the invocation panicked
+	panicked  bool
+	recovered interface{}
+}
+
+// detached is a context with the values of another, but which is never done,
+// so that an invocation shared by several callers is not cancelled by the one
+// that made it
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
+
+// Memoize wraps fn so that its results are cached in c. Concurrent calls for
+// a key that is not cached share a single invocation of fn. Errors are
+// returned to every caller waiting on that invocation, but are not cached.
+func Memoize(c Cache, fn func(key interface{}) (interface{}, error)) func(key interface{}) (interface{}, error) {
+	m := MemoizeContext(c, func(_ context.Context, key interface{}) (interface{}, error) {
+		return fn(key)
+	})
+
+	return func(key interface{}) (interface{}, error) {
+		return m(context.Background(), key)
+	}
+}
+
+// MemoizeContext is like Memoize for functions that take a context. fn is
+// passed a context with the values of the context of the caller that
+// triggered the invocation, but which is never done. Every caller, including
+// that one, stops waiting with ErrLoadTimeout once its own context is done,
+// while the invocation runs on for the rest.
+//
+// If c was created WithLoadCooldown, fn is invoked at most once per cooldown
+// interval for a key that is cooling down. Misses in between get the value, or
+// error, of that invocation without it being cached again.
+//
+// If fn panics, the caller that triggered the invocation panics with the same
+// value, if it is still waiting, and the other callers get ErrLoadPanic.
+func MemoizeContext(c Cache, fn func(ctx context.Context, key interface{}) (interface{}, error)) func(ctx context.Context, key interface{}) (interface{}, error) {
+	l := newLoader(c)
+
+	return func(ctx context.Context, key interface{}) (interface{}, error) {
+		return l.load(ctx, key, func(ctx context.Context) (interface{}, error) {
+			return fn(ctx, key)
+		})
+	}
+}
+
+// loader coalesces the loads of keys missing from a cache
+type loader struct {
+	c  Cache
+	cc *cache
+
+	lock  sync.Mutex
+	calls map[interface{}]*call
+
+	// recent holds the invocations made while their key was cooling down
+	recent map[interface{}]*call
+}
+
+func newLoader(c Cache) *loader {
+	cc, _ := c.(*cache)
+
+	return &loader{
+		c:      c,
+		cc:     cc,
+		calls:  map[interface{}]*call{},
+		recent: map[interface{}]*call{},
+	}
+}
+
+// load returns the value of key in the cache, or invokes fn to load it into
+// the cache if it is missing, as described by MemoizeContext
+func (l *loader) load(ctx context.Context, key interface{}, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if value, ok := l.c.Get(key); ok {
+		return value, nil
+	}
+
+	l.lock.Lock()
+	if cl, ok := l.calls[key]; ok {
+		l.lock.Unlock()
+
+		select {
+		case <-cl.done:
+			return cl.value, cl.err
+		case <-ctx.Done():
+			return nil, ErrLoadTimeout
+		}
+	}
+
+	// an invocation may have set the key since it was missed. Peek does not
+	// run callbacks, which could call back into the loader while it is locked.
+	if value, ok := l.c.Peek(key); ok {
+		l.lock.Unlock()
+		return value, nil
+	}
+
+	var (
+		interval time.Duration
+		max      int
+		cooling  bool
+	)
+	if l.cc != nil {
+		interval, max, cooling = l.cc.cooldown(key)
+	}
+
+	if cl, ok := l.recent[key]; ok {
+		if cooling && time.Since(cl.at) < interval {
+			l.lock.Unlock()
+			return cl.value, cl.err
+		}
+		delete(l.recent, key)
+	}
+
+	cl := &call{done: make(chan struct{})}
+	l.calls[key] = cl
+	l.lock.Unlock()
+
+	go func() {
+		var returned bool
+		defer func() {
+			if !returned {
+				cl.recovered, cl.panicked = recover(), true
+				cl.value, cl.err = nil, ErrLoadPanic
+			}
+
+			l.lock.Lock()
+			delete(l.calls, key)
+			if cooling && returned {
+				cl.at = time.Now()
+				l.recent[key] = cl
+				forgetCooled(l.recent, max, interval)
+			}
+			l.lock.Unlock()
+			close(cl.done)
+		}()
+
+		cl.value, cl.err = fn(detached{ctx})
+		returned = true
+		if cl.err == nil {
+			l.c.Set(key, cl.value)
+		}
+	}()
+
+	select {
+	case <-cl.done:
+		if cl.panicked {
+			panic(cl.recovered)
+		}
+		return cl.value, cl.err
+	case <-ctx.Done():
+		return nil, ErrLoadTimeout
+	}
+}
+
+func (c *cache) Fetch(key interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	return c.fetches.load(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// forgetCooled drops the invocations in recent that are older than interval
+// once it holds more than max of them
+func forgetCooled(recent map[interface{}]*call, max int, interval time.Duration) {
+	if len(recent) <= max {
+		return
+	}
+
+	for key, cl := range recent {
+		if time.Since(cl.at) >= interval {
+			delete(recent, key)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package ttlru
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithLastWriteWins timestamps every Set, Del and Purge, and the ops they
+// record in the Oplog. When ops are replayed with Apply, the write with the
+// newest timestamp wins, so caches exchanging their ops converge on the same
+// contents regardless of the order the ops arrive in. A local write is always
+// timestamped after the item it replaces, even when that item came from a
+// replica whose clock is ahead. Deletes are remembered, for up to as many keys
+// as the capacity of the cache, so that older writes arriving late do not
+// resurrect them.
+func WithLastWriteWins() Option {
+	return func(c *cache) error {
+		c.lww = true
+		return nil
+	}
+}
+
+// WithMergeFunc resolves conflicts when Apply sets a key that already exists
+// by storing the result of fn instead of the remote value. fn must be
+// commutative and associative for caches exchanging ops to converge.
+func WithMergeFunc(fn func(key, local, remote interface{}) interface{}) Option {
+	return func(c *cache) error {
+		c.mergeFunc = fn
+		return nil
+	}
+}
+
+// WithTombstones remembers items removed by Del for window, during which Set
+// and SetIfNewer of their keys are ignored. This keeps a slow writer that
+// loaded a value before it was deleted from resurrecting it. As with
+// WithLastWriteWins, up to as many deletes are remembered as the capacity of
+// the cache.
+func WithTombstones(window time.Duration) Option {
+	return func(c *cache) error {
+		if window <= 0 {
+			return fmt.Errorf("ttlru: tombstone window %v is not positive", window)
+		}
+		c.tombstoneWindow = window
+		return nil
+	}
+}
+
+// mourning reports whether key was deleted within the tombstone window
+func (c *cache) mourning(key interface{}) bool {
+	// must already have a write lock
+
+	if c.tombstoneWindow <= 0 {
+		return false
+	}
+
+	dead, ok := c.tombstones[key]
+	return ok && time.Since(dead) < c.tombstoneWindow
+}
+
+// nextStamp returns the timestamp for a local write of key
+func (c *cache) nextStamp(key interface{}) time.Time {
+	// must already have a write lock
+
+	latest := c.purgeStamp
+	if ent, ok := c.items[key]; ok && ent.stamp.After(latest) {
+		latest = ent.stamp
+	}
+	if ts, ok := c.tombstones[key]; ok && ts.After(latest) {
+		latest = ts
+	}
+
+	if now := time.Now(); now.After(latest) {
+		return now
+	}
+	return latest.Add(1)
+}
+
+// bury remembers that key was deleted at ts
+func (c *cache) bury(key interface{}, ts time.Time) {
+	// must already have a write lock
+
+	if c.tombstones == nil {
+		c.tombstones = map[interface{}]time.Time{}
+	}
+
+	old, ok := c.tombstones[key]
+	if !ok {
+		c.tombstoneKeys = append(c.tombstoneKeys, key)
+	}
+	if ts.After(old) {
+		c.tombstones[key] = ts
+	}
+
+	// keys set since they were deleted are no longer in the map, but still
+	// in the queue, and are queued again if deleted again
+	if len(c.tombstoneKeys) > 2*len(c.tombstones) {
+		c.compactTombstones()
+	}
+
+	// forget the oldest deletes
+	for len(c.tombstones) > c.cap {
+		delete(c.tombstones, c.tombstoneKeys[0])
+		c.tombstoneKeys = c.tombstoneKeys[1:]
+	}
+}
+
+// compactTombstones rebuilds the queue of tombstones with only the keys still
+// in the map, each at its latest place in the queue
+func (c *cache) compactTombstones() {
+	// must already have a write lock
+
+	seen := make(map[interface{}]bool, len(c.tombstones))
+	keys := make([]interface{}, len(c.tombstones))
+	n := len(keys)
+	for i := len(c.tombstoneKeys) - 1; i >= 0 && n > 0; i-- {
+		key := c.tombstoneKeys[i]
+		if _, ok := c.tombstones[key]; ok && !seen[key] {
+			seen[key] = true
+			n--
+			keys[n] = key
+		}
+	}
+
+	c.tombstoneKeys = keys[n:]
+}
+
+// buried reports whether a write of key stamped ts is older than its delete,
+// or the last purge
+func (c *cache) buried(key interface{}, ts time.Time) bool {
+	// must already have a write lock
+
+	if !ts.After(c.purgeStamp) {
+		return true
+	}
+
+	dead, ok := c.tombstones[key]
+	return ok && !ts.After(dead)
+}
+
+// wins reports whether a remote write stamped ts with value beats the entry
+func wins(ts time.Time, value interface{}, e *entry) bool {
+	if !ts.Equal(e.stamp) {
+		return ts.After(e.stamp)
+	}
+
+	// break ties the same way on every cache
+	return fmt.Sprint(value) > fmt.Sprint(e.value)
+}
+
+func (c *cache) Apply(op Op) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	switch op.Kind {
+	case OpSet:
+		stamp, value := op.Stamp, op.Value
+
+		if c.shutdown || (c.lww && c.buried(op.Key, stamp)) {
+			return false
+		}
+
+		if ent, ok := c.items[op.Key]; ok {
+			switch {
+			case c.mergeFunc != nil:
+				var ok bool
+				if value, ok = c.merge(op.Key, ent.value, op.Value); !ok {
+					return false
+				}
+				if ent.stamp.After(stamp) {
+					stamp = ent.stamp
+				}
+			case c.lww && !wins(op.Stamp, op.Value, ent):
+				return false
+			}
+		}
+
+		ent, _ := c.set(op.Key, value, c.storedTTL(op.Key, value), op.options(c))
+		ent.stamp = stamp
+		delete(c.tombstones, op.Key)
+
+		return true
+
+	case OpDel:
+		if c.lww {
+			c.bury(op.Key, op.Stamp)
+		}
+
+		c.queueSpill(spillOp{kind: OpDel, key: op.Key})
+
+		ent, ok := c.items[op.Key]
+		if !ok || (c.lww && !op.Stamp.After(ent.stamp)) {
+			return false
+		}
+
+		c.removeEntry(ent)
+
+		return true
+
+	case OpPurge:
+		if !c.lww {
+			c.purge()
+			return true
+		}
+
+		if op.Stamp.After(c.purgeStamp) {
+			c.purgeStamp = op.Stamp
+		}
+
+		// spilled entries have no stamps to compare
+		c.queueSpill(spillOp{kind: OpPurge})
+
+		var changed bool
+		for _, ent := range c.items {
+			if op.Stamp.After(ent.stamp) {
+				c.removeEntry(ent)
+				changed = true
+			}
+		}
+
+		return changed
+	}
+
+	return false
+}
@@ -0,0 +1,31 @@
+package ttlru
+
+func (c *cache) SetWithMeta(key, value, meta interface{}, opts ...SetOption) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	// never append to the backing array of the caller's options
+	opts = append(opts[:len(opts):len(opts)], func(e *entry) {
+		e.meta = meta
+	})
+
+	evicted, _ := c.store(key, value, opts)
+	return evicted
+}
+
+func (c *cache) GetWithMeta(key interface{}) (interface{}, interface{}, bool) {
+	return c.getWithMeta(key, false)
+}
+
+func (c *cache) getWithMeta(key interface{}, view bool) (interface{}, interface{}, bool) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if ent := c.access(key, !c.NoReset, view); ent != nil {
+		if value, ok := c.plain(ent.value); ok {
+			return value, ent.meta, true
+		}
+	}
+
+	return nil, nil, false
+}
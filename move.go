@@ -0,0 +1,68 @@
+package ttlru
+
+import "container/heap"
+
+// cacheIDs counts the caches created, to give each its id
+var cacheIDs uint64
+
+func (c *cache) Move(key interface{}, dst Cache) bool {
+	d, ok := dst.(*cache)
+	if !ok {
+		// such as a read only view
+		return false
+	}
+
+	if d == c {
+		return c.Contains(key)
+	}
+
+	// always lock the older cache first, so that concurrent moves in opposite
+	// directions can not deadlock
+	first, second := c, d
+	if d.id < c.id {
+		first, second = d, c
+	}
+	first.lock.Lock()
+	second.lock.Lock()
+	defer func() {
+		// the callbacks of either cache run once neither is locked
+		w := second.unlockDeferring()
+		first.unlockDeferring().run()
+		w.run()
+	}()
+
+	ent, ok := c.items[key]
+	if !ok || !ent.live(c.clock()) || (ent.ref != nil && ent.ref.count > 0) {
+		return false
+	}
+
+	value, ok := c.plain(ent.value)
+	if !ok || d.mourning(key) {
+		return false
+	}
+
+	onExpire, uses, meta := ent.onExpire, ent.uses, ent.meta
+	if _, err := d.store(key, value, []SetOption{func(e *entry) {
+		e.onExpire, e.uses, e.meta = onExpire, uses, meta
+	}}); err != nil {
+		return false
+	}
+
+	moved, ok := d.items[key]
+	if !ok {
+		// evicted right away to make room for another, so it stays put
+		return false
+	}
+
+	moved.ttl = ent.ttl
+	moved.expires = ent.expires
+	moved.created = ent.created
+	d.armEntry(moved)
+	heap.Fix(moved.heap, moved.index)
+
+	// the value now lives on in dst, so it is not destroyed
+	c.detach(key)
+	ent.ref = nil
+
+	return true
+}
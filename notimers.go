@@ -0,0 +1,9 @@
+//go:build ttlru_notimers || tinygo
+// +build ttlru_notimers tinygo
+
+package ttlru
+
+// notimers forces every cache to expire its items lazily, as if created with
+// WithoutTimers. It is set by the ttlru_notimers build tag, and when built
+// with TinyGo.
+const notimers = true
@@ -0,0 +1,40 @@
+//go:build ttlru_notimers
+// +build ttlru_notimers
+
+package ttlru
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoTimersBuild(t *testing.T) {
+	require.False(t, TimersSupported)
+
+	goroutines := runtime.NumGoroutine()
+
+	l := New(2, WithTTL(10*time.Millisecond), WithTimerGranularity(time.Millisecond), WithExpiredChannel(2))
+	require.NotNil(t, l)
+
+	l.Set(1, 1)
+	l.Set(2, 2)
+	require.Equal(t, 0, l.ConsistencyReport().Timers)
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok := l.Get(1)
+	require.False(t, ok)
+	l.Set(3, 3)
+	require.Len(t, l.Expired(), 2)
+
+	require.NoError(t, l.Shutdown(context.Background()))
+	require.Equal(t, goroutines, runtime.NumGoroutine())
+
+	_, err := NewWithError(1, WithMemoryLimitShedding(0.9, 0.1, time.Second))
+	require.Error(t, err)
+	_, _, err = NewContextCache(context.Background(), 1)
+	require.Error(t, err)
+}
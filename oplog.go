@@ -0,0 +1,110 @@
+package ttlru
+
+import (
+	"fmt"
+	"time"
+)
+
+// OpKind is the kind of mutation an Op records
+type OpKind int
+
+const (
+	// OpSet records that Key was set to Value
+	OpSet OpKind = iota
+
+	// OpDel records that Key was deleted
+	OpDel
+
+	// OpPurge records that all keys were removed
+	OpPurge
+)
+
+// Op is a mutation of the cache delivered to the channel returned by Oplog.
+// Replaying the ops, in order, on another cache with the same options keeps
+// it in sync.
+type Op struct {
+	Kind  OpKind
+	Key   interface{}
+	Value interface{}
+
+	// Stamp is the timestamp given to SetIfNewer, if any
+	Stamp time.Time
+
+	// TTL is the TTL given to SetWithTTL, if any. It is negative for a TTL
+	// that never expires, so that it is not mistaken for no TTL at all.
+	TTL time.Duration
+
+	// VisibleAt is the time given to SetAt, if any
+	VisibleAt time.Time
+}
+
+// opTTL returns ttl as it is recorded in an Op
+func opTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+// options returns the options that give an entry set by Apply the TTL and
+// visibility recorded in the op
+func (op Op) options(c *cache) []SetOption {
+	var opts []SetOption
+
+	if op.TTL != 0 {
+		ttl := c.boundTTL(op.TTL)
+		opts = append(opts, func(e *entry) {
+			e.ttl = ttl
+		})
+	}
+
+	if !op.VisibleAt.IsZero() {
+		opts = append(opts, func(e *entry) {
+			e.visible = op.VisibleAt
+		})
+	}
+
+	return opts
+}
+
+// WithOplog delivers every Set, Del and Purge to the channel returned by
+// Oplog. The channel is buffered with size ops. When it is full, ops are
+// dropped and counted by OplogOverflow instead of blocking the cache.
+// Expirations and evictions are not recorded as a replica with the same
+// options expires and evicts entries on its own.
+func WithOplog(size int) Option {
+	return func(c *cache) error {
+		if size < 0 {
+			return fmt.Errorf("ttlru: negative oplog size %d", size)
+		}
+		if c.running {
+			return errRunning("WithOplog")
+		}
+		c.oplog = make(chan Op, size)
+		return nil
+	}
+}
+
+func (c *cache) emit(op Op) {
+	// must already have a write lock
+
+	if c.oplog == nil {
+		return
+	}
+
+	select {
+	case c.oplog <- op:
+	default:
+		c.oplogOverflow++
+	}
+}
+
+func (c *cache) Oplog() <-chan Op {
+	return c.oplog
+}
+
+func (c *cache) OplogOverflow() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.oplogOverflow
+}
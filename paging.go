@@ -0,0 +1,86 @@
+package ttlru
+
+import (
+	"sort"
+	"strconv"
+)
+
+// appendOrder adds a newly inserted entry to the insertion order index
+func (c *cache) appendOrder(ent *entry) {
+	// must already have a write lock
+
+	// removed entries are only dropped once they make up over half of the
+	// index, so that dropping them is amortized over the inserts
+	if len(c.order) > 2*len(c.items) {
+		c.compactOrder()
+	}
+
+	c.order = append(c.order, ent)
+}
+
+// compactOrder drops the entries that were removed from the cache from the
+// insertion order index
+func (c *cache) compactOrder() {
+	// must already have a write lock
+
+	order := make([]*entry, 0, len(c.items))
+	for _, e := range c.order {
+		if c.current(e) {
+			order = append(order, e)
+		}
+	}
+	c.order = order
+}
+
+// current reports whether e is still the entry of its key
+func (c *cache) current(e *entry) bool {
+	return c.items[e.key] == e
+}
+
+func (c *cache) KeysPage(cursor string, limit int) ([]interface{}, string) {
+	var after uint64
+	if cursor != "" {
+		var err error
+		if after, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, ""
+		}
+	}
+
+	if limit <= 0 {
+		return nil, ""
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := c.clock()
+
+	// the index is in insertion order, so the page starts at the first entry
+	// inserted after the cursor
+	i := sort.Search(len(c.order), func(i int) bool {
+		return c.order[i].seq > after
+	})
+
+	n := limit
+	if n > len(c.items) {
+		n = len(c.items)
+	}
+
+	keys := make([]interface{}, 0, n)
+	var last uint64
+	for ; i < len(c.order); i++ {
+		e := c.order[i]
+		if !c.current(e) || !e.live(now) {
+			continue
+		}
+
+		if len(keys) == limit {
+			return keys, strconv.FormatUint(last, 10)
+		}
+
+		keys = append(keys, e.key)
+		last = e.seq
+	}
+
+	return keys, ""
+}
@@ -0,0 +1,193 @@
+package ttlru
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points each partition has on the hash ring
+const virtualNodes = 128
+
+// Partition is the part of Cache that Partitioned spreads keys across. Every
+// Cache is a Partition, but so may be a client of a cache in another process.
+type Partition interface {
+	Set(key, value interface{}, opts ...SetOption) bool
+	Get(key interface{}) (interface{}, bool)
+	Del(key interface{}) bool
+}
+
+// PartitionOption configures a Partitioned
+type PartitionOption func(*Partitioned)
+
+// WithReplicas stores each key in n distinct partitions. It defaults to 1.
+func WithReplicas(n int) PartitionOption {
+	return func(p *Partitioned) {
+		p.replicas = n
+	}
+}
+
+// WithKeyHash sets the function used to place keys on the hash ring. The
+// default hashes the fmt.Sprint representation of the key with FNV-1a.
+func WithKeyHash(fn func(key interface{}) uint64) PartitionOption {
+	return func(p *Partitioned) {
+		p.hash = fn
+	}
+}
+
+// WithPartitionNames gives each partition, in order, a name that places it on
+// the hash ring. Without names, partitions are placed by their position in
+// the slice, so removing any partition but the last also moves the keys of
+// those after it. The names must be distinct, one for each partition.
+func WithPartitionNames(names ...string) PartitionOption {
+	return func(p *Partitioned) {
+		p.names = names
+	}
+}
+
+// Partitioned consistently hashes keys across several partitions, so that
+// adding or removing a named partition only moves the keys of that partition.
+type Partitioned struct {
+	partitions []Partition
+	names      []string
+	replicas   int
+	hash       func(key interface{}) uint64
+	ring       []point
+}
+
+// point is a position on the hash ring owned by a partition
+type point struct {
+	hash      uint64
+	partition int
+}
+
+// NewPartitioned creates a Partitioned spreading keys across partitions. It
+// returns nil if there are no partitions, fewer than the number of replicas,
+// or names that do not match them.
+func NewPartitioned(partitions []Partition, opts ...PartitionOption) *Partitioned {
+	p := Partitioned{
+		partitions: partitions,
+		replicas:   1,
+		hash:       hashKey,
+	}
+
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	if len(partitions) == 0 || p.replicas <= 0 || p.replicas > len(partitions) {
+		return nil
+	}
+
+	if p.names == nil {
+		p.names = make([]string, len(partitions))
+		for i := range partitions {
+			p.names[i] = strconv.Itoa(i)
+		}
+	}
+
+	if len(p.names) != len(partitions) {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(p.names))
+	for _, name := range p.names {
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+	}
+
+	p.ring = make([]point, 0, len(partitions)*virtualNodes)
+	for i, name := range p.names {
+		for j := 0; j < virtualNodes; j++ {
+			p.ring = append(p.ring, point{
+				hash:      hashString(name + "-" + strconv.Itoa(j)),
+				partition: i,
+			})
+		}
+	}
+
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+
+	return &p
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return mix(h.Sum64())
+}
+
+// mix is the splitmix64 finalizer. FNV-1a alone clusters similar short
+// strings, which would leave the ring unbalanced.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func hashKey(key interface{}) uint64 {
+	return hashString(fmt.Sprint(key))
+}
+
+// Partitions returns the partitions key is stored in, primary first
+func (p *Partitioned) Partitions(key interface{}) []Partition {
+	h := p.hash(key)
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+
+	parts := make([]Partition, 0, p.replicas)
+	seen := make(map[int]bool, p.replicas)
+
+	for n := 0; len(parts) < p.replicas; n++ {
+		pt := p.ring[(i+n)%len(p.ring)]
+		if !seen[pt.partition] {
+			seen[pt.partition] = true
+			parts = append(parts, p.partitions[pt.partition])
+		}
+	}
+
+	return parts
+}
+
+// Set a key with value to each of its partitions. Returns true if an item was
+// evicted from any of them.
+func (p *Partitioned) Set(key, value interface{}, opts ...SetOption) bool {
+	var evicted bool
+	for _, part := range p.Partitions(key) {
+		if part.Set(key, value, opts...) {
+			evicted = true
+		}
+	}
+	return evicted
+}
+
+// Get an item by key from the first of its partitions that has it
+func (p *Partitioned) Get(key interface{}) (interface{}, bool) {
+	for _, part := range p.Partitions(key) {
+		if value, ok := part.Get(key); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Del deletes an item by key from each of its partitions. Returns if an item
+// was actually deleted from any of them.
+func (p *Partitioned) Del(key interface{}) bool {
+	var deleted bool
+	for _, part := range p.Partitions(key) {
+		if part.Del(key) {
+			deleted = true
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,106 @@
+// Package ratelimit provides per-key token bucket rate limits, held in a
+// ttlru cache so that keys which have been idle long enough to refill their
+// bucket expire from it.
+package ratelimit // import "zvelo.io/ttlru/ratelimit"
+
+import (
+	"sync"
+	"time"
+
+	"zvelo.io/ttlru"
+)
+
+// Limiter allows each key up to burst events at once, refilling at rate
+// events per second
+type Limiter struct {
+	rate  float64
+	burst float64
+	cache ttlru.Cache
+
+	// serializes the creation of buckets
+	lock sync.Mutex
+}
+
+// bucket is the token bucket of a single key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a Limiter tracking up to cap keys. When more keys are active,
+// the bucket of the one idle the longest is forgotten, and it starts over
+// with a full bucket. It returns nil if any of the arguments are not
+// positive.
+func New(cap int, rate float64, burst int) *Limiter {
+	if rate <= 0 || burst <= 0 {
+		return nil
+	}
+
+	// an idle bucket is full again once it could have refilled every
+	// token, so there is no need to remember it any longer
+	ttl := time.Duration(float64(burst) / rate * float64(time.Second))
+
+	c := ttlru.New(cap, ttlru.WithTTL(ttl))
+	if c == nil {
+		return nil
+	}
+
+	return &Limiter{
+		rate:  rate,
+		burst: float64(burst),
+		cache: c,
+	}
+}
+
+// Allow reports whether an event for key may happen now, taking a token from
+// its bucket if so
+func (l *Limiter) Allow(key interface{}) bool {
+	now := time.Now()
+
+	var allowed bool
+	take := func(value *interface{}) {
+		allowed = l.take((*value).(*bucket), now)
+	}
+
+	if l.cache.WithLockedValue(key, take) {
+		return allowed
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// another event may have created the bucket in the meantime
+	if l.cache.WithLockedValue(key, take) {
+		return allowed
+	}
+
+	b := &bucket{tokens: l.burst, last: now}
+	allowed = l.take(b, now)
+	l.cache.Set(key, b)
+
+	return allowed
+}
+
+func (l *Limiter) take(b *bucket, now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Len returns the number of keys being tracked. When built without timers,
+// as with the ttlru_notimers tag, idle keys are only removed as new keys are
+// tracked, so they are counted until then.
+func (l *Limiter) Len() int {
+	return l.cache.Len()
+}
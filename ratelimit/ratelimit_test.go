@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllow(t *testing.T) {
+	require.Nil(t, New(1, 0, 1))
+	require.Nil(t, New(1, 1, 0))
+	require.Nil(t, New(0, 1, 1))
+
+	l := New(2, 50, 2)
+	require.NotNil(t, l)
+
+	require.True(t, l.Allow("a"))
+	require.True(t, l.Allow("a"))
+	require.False(t, l.Allow("a"))
+
+	// keys have separate buckets
+	require.True(t, l.Allow("b"))
+
+	// a token is refilled every 20ms
+	time.Sleep(25 * time.Millisecond)
+	require.True(t, l.Allow("a"))
+	require.False(t, l.Allow("a"))
+
+	// idle keys are forgotten once their bucket is full again, by the time
+	// another key is tracked even without timers
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, l.Allow("c"))
+	require.Equal(t, 1, l.Len())
+}
+
+func TestAllowConcurrent(t *testing.T) {
+	l := New(1, 0.001, 10)
+	require.NotNil(t, l)
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.Allow("a") {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(10), allowed)
+}
@@ -0,0 +1,239 @@
+package ttlru
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrReadOnly is returned by the methods of a read only view of a cache that
+// would otherwise have modified it
+var ErrReadOnly = errors.New("ttlru: cache is read only")
+
+// readOnly is a view of a cache that can not modify it. Every method is
+// implemented explicitly, rather than by embedding, so that new methods of
+// Cache are not made available to the view by accident.
+type readOnly struct {
+	c *cache
+}
+
+func (c *cache) ReadOnly() Cache {
+	return readOnly{c: c}
+}
+
+func (r readOnly) ReadOnly() Cache {
+	return r
+}
+
+func (r readOnly) Set(key, value interface{}, opts ...SetOption) bool {
+	return false
+}
+
+func (r readOnly) TrySet(key, value interface{}, opts ...SetOption) (bool, error) {
+	return false, ErrReadOnly
+}
+
+func (r readOnly) SetIfNewer(key, value interface{}, ts time.Time, opts ...SetOption) bool {
+	return false
+}
+
+func (r readOnly) SetWithMeta(key, value, meta interface{}, opts ...SetOption) bool {
+	return false
+}
+
+func (r readOnly) SetAt(key, value interface{}, visibleAt time.Time, opts ...SetOption) bool {
+	return false
+}
+
+func (r readOnly) SetWithTTL(key, value interface{}, ttl time.Duration, opts ...SetOption) bool {
+	return false
+}
+
+// Get, like the other reads of the view that count as accesses, misses items
+// set WithMaxUses rather than use them up
+func (r readOnly) Get(key interface{}) (interface{}, bool) {
+	start := r.c.sample()
+	value, ok := r.c.get(key, true, true)
+	r.c.trace(key, hitOrMiss(ok), start)
+	return value, ok
+}
+
+func (r readOnly) TryGet(key interface{}) (interface{}, bool, error) {
+	return r.c.tryGet(key, true)
+}
+
+func (r readOnly) GetNoReset(key interface{}) (interface{}, bool) {
+	start := r.c.sample()
+	value, ok := r.c.get(key, false, true)
+	r.c.trace(key, hitOrMiss(ok), start)
+	return value, ok
+}
+
+func (r readOnly) Peek(key interface{}) (interface{}, bool) {
+	return r.c.Peek(key)
+}
+
+func (r readOnly) Contains(key interface{}) bool {
+	return r.c.Contains(key)
+}
+
+func (r readOnly) GetFresh(key interface{}, maxAge time.Duration) (interface{}, bool) {
+	return r.c.getFresh(key, maxAge, true)
+}
+
+func (r readOnly) GetWithMeta(key interface{}) (interface{}, interface{}, bool) {
+	return r.c.getWithMeta(key, true)
+}
+
+func (r readOnly) GetWithExpiration(key interface{}) (interface{}, time.Time, bool) {
+	return r.c.getWithExpiration(key, true)
+}
+
+func (r readOnly) Lookup(keys []interface{}) []Result {
+	return r.c.lookupKeys(keys, true)
+}
+
+// WithLockedValue lets fn see the value, but never stores a replacement. As
+// with Get, values that are pointers can still be modified through them.
+func (r readOnly) WithLockedValue(key interface{}, fn func(value *interface{})) bool {
+	return r.c.withLockedValue(key, func(value *interface{}) {
+		orig := *value
+		fn(value)
+		*value = orig
+	}, true)
+}
+
+func (r readOnly) Keys() []interface{} {
+	return r.c.Keys()
+}
+
+func (r readOnly) AppendKeys(dst []interface{}) []interface{} {
+	return r.c.AppendKeys(dst)
+}
+
+func (r readOnly) AppendValues(dst []interface{}) []interface{} {
+	return r.c.AppendValues(dst)
+}
+
+func (r readOnly) KeysPage(cursor string, limit int) ([]interface{}, string) {
+	return r.c.KeysPage(cursor, limit)
+}
+
+func (r readOnly) Len() int {
+	return r.c.Len()
+}
+
+func (r readOnly) Cap() int {
+	return r.c.Cap()
+}
+
+func (r readOnly) Purge() {}
+
+func (r readOnly) Del(key interface{}) bool {
+	return false
+}
+
+func (r readOnly) DelGet(key interface{}) (interface{}, bool) {
+	return nil, false
+}
+
+func (r readOnly) Fetch(key interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	if value, ok := r.Get(key); ok {
+		return value, nil
+	}
+	return nil, ErrReadOnly
+}
+
+func (r readOnly) Rename(oldKey, newKey interface{}) bool {
+	return false
+}
+
+func (r readOnly) Move(key interface{}, dst Cache) bool {
+	return false
+}
+
+// Expired returns nil, as receiving from the channel would take the
+// notifications from the owner of the cache
+func (r readOnly) Expired() <-chan Entry {
+	return nil
+}
+
+func (r readOnly) Age(key interface{}) (time.Duration, bool) {
+	return r.c.Age(key)
+}
+
+func (r readOnly) ExpiredOverflow() uint64 {
+	return r.c.ExpiredOverflow()
+}
+
+func (r readOnly) GetEntry(key interface{}) (Entry, bool) {
+	return r.c.GetEntry(key)
+}
+
+func (r readOnly) Entries() []Entry {
+	return r.c.Entries()
+}
+
+func (r readOnly) ExpiringWithin(d time.Duration) []Entry {
+	return r.c.ExpiringWithin(d)
+}
+
+func (r readOnly) AppendEntries(dst []Entry) []Entry {
+	return r.c.AppendEntries(dst)
+}
+
+// Oplog returns nil, as receiving from the channel would take the ops from
+// the owner of the cache
+func (r readOnly) Oplog() <-chan Op {
+	return nil
+}
+
+func (r readOnly) OplogOverflow() uint64 {
+	return r.c.OplogOverflow()
+}
+
+func (r readOnly) Shrink() {}
+
+func (r readOnly) Pause() {}
+
+func (r readOnly) Resume() {}
+
+// Acquire always misses, as a lease keeps the entry from being evicted or
+// destroyed
+func (r readOnly) Acquire(key interface{}) (interface{}, func(), bool) {
+	return nil, nil, false
+}
+
+func (r readOnly) Configure(opts ...Option) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Apply(op Op) bool {
+	return false
+}
+
+func (r readOnly) Warm(ctx context.Context, src func(yield func(key, value interface{}) bool)) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) HeapDepth() int {
+	return r.c.HeapDepth()
+}
+
+func (r readOnly) MapLen() int {
+	return r.c.MapLen()
+}
+
+func (r readOnly) ConsistencyReport() Consistency {
+	return r.c.ConsistencyReport()
+}
+
+func (r readOnly) Stats() Stats {
+	return r.c.Stats()
+}
+
+func (r readOnly) Close() {}
+
+func (r readOnly) Shutdown(ctx context.Context) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,41 @@
+package ttlru
+
+import "time"
+
+func (c *cache) Rename(oldKey, newKey interface{}) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent, ok := c.items[oldKey]
+	if !ok || !ent.live(c.clock()) || c.mourning(newKey) {
+		return false
+	}
+
+	if oldKey == newKey {
+		return true
+	}
+
+	if old, ok := c.items[newKey]; ok {
+		c.removeEntry(old)
+	}
+
+	var oldStamp, newStamp time.Time
+	if c.lww {
+		oldStamp, newStamp = c.nextStamp(oldKey), c.nextStamp(newKey)
+		c.bury(oldKey, oldStamp)
+		delete(c.tombstones, newKey)
+		ent.stamp = newStamp
+	}
+
+	// the expiration timer of the entry looks it up by its key, so it follows
+	// the entry to its new key
+	delete(c.items, oldKey)
+	ent.key = newKey
+	c.items[newKey] = ent
+
+	c.queueSpill(spillOp{kind: OpDel, key: newKey})
+	c.emit(Op{Kind: OpDel, Key: oldKey, Stamp: oldStamp})
+	c.emit(Op{Kind: OpSet, Key: newKey, Value: ent.value, Stamp: newStamp})
+
+	return true
+}
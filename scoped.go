@@ -0,0 +1,82 @@
+package ttlru
+
+// WithoutTimers expires items lazily rather than with timers: expired items
+// are no longer returned, and are removed as new ones are set, or when they
+// are the soonest expiring item evicted to make room. Caches without timers
+// never start goroutines, so callbacks run synchronously in the goroutine
+// whose call removed the items, and options that need background work,
+// WithMemoryLimitShedding and WithOldestAgeAlert, are invalid. Building with
+// the ttlru_notimers tag applies it to every cache.
+func WithoutTimers() Option {
+	return func(c *cache) error {
+		if c.running {
+			return errRunning("WithoutTimers")
+		}
+		c.lazy = true
+		return nil
+	}
+}
+
+// NewScoped creates a cache for short lived scopes, such as a single request
+// or connection, that is cheap to create and to throw away. It has no timers,
+// as if created WithoutTimers. Get, GetNoReset and Peek fall back to parent,
+// if it is not nil, for keys the scope does not hold, without storing what
+// they find. It returns nil if cap is not positive or any of the options are
+// invalid.
+func NewScoped(cap int, parent Cache, opts ...Option) Cache {
+	c, err := NewScopedWithError(cap, parent, opts...)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// NewScopedWithError is like NewScoped, but returns an error describing why
+// cap or the options are invalid, rather than nil.
+func NewScopedWithError(cap int, parent Cache, opts ...Option) (Cache, error) {
+	scoped := func(c *cache) error {
+		c.parent = parent
+		return nil
+	}
+
+	return NewWithError(cap, append([]Option{WithoutTimers(), scoped}, opts...)...)
+}
+
+// get returns the value of key, falling back to the parent cache of a scope.
+// The TTL of the item is reset if reset is set, unless the cache is
+// configured WithoutReset. view is set for reads through a read only view,
+// which fall back to a read only view of the parent.
+func (c *cache) get(key interface{}, reset, view bool) (interface{}, bool) {
+	if value, ok := c.lookup(key, reset, view); ok || c.parent == nil {
+		return value, ok
+	}
+
+	parent := c.parent
+	if view {
+		parent = parent.ReadOnly()
+	}
+
+	if reset {
+		return parent.Get(key)
+	}
+
+	return parent.GetNoReset(key)
+}
+
+// reap expires the soonest expiring entries of a cache without timers while
+// they are dead. Entries that never expire sort after all the others, so they
+// do not keep those behind them from being reaped.
+func (c *cache) reap() {
+	// must already have a write lock
+
+	now := c.clock()
+	for _, h := range c.heaps() {
+		for h.Len() > 0 {
+			e := (*h)[0]
+			if !e.dead(now) || e.leased() {
+				break
+			}
+			c.expireEntry(e)
+		}
+	}
+}
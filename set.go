@@ -0,0 +1,65 @@
+package ttlru
+
+import "time"
+
+// StringSet is a set of strings that each leave the set once ttl has elapsed
+// since they were last added, such as for deduplicating within a window
+type StringSet struct {
+	c *cache
+}
+
+// NewStringSet creates a StringSet holding up to cap strings. When it is
+// full, adding a string removes the one that would leave the set soonest. It
+// returns nil if cap is not positive or ttl is negative.
+func NewStringSet(cap int, ttl time.Duration) *StringSet {
+	c, err := NewWithError(cap, WithTTL(ttl))
+	if err != nil {
+		return nil
+	}
+	return &StringSet{c: c.(*cache)}
+}
+
+// Add adds str to the set, or restarts its ttl if it is already a member.
+// Returns true if str was not already a member.
+func (s *StringSet) Add(str string) bool {
+	times, _ := s.Seen(str)
+	return times == 1
+}
+
+// Seen is like Add, but returns the number of times str has been added since
+// it last joined the set, including this one, and when it joined
+func (s *StringSet) Seen(str string) (int, time.Time) {
+	s.c.lock.Lock()
+	defer s.c.unlock()
+
+	// the value of each member is the number of times it was added
+	var times int
+	if ent, ok := s.c.items[str]; ok {
+		if !ent.dead(s.c.clock()) {
+			times = ent.value.(int)
+		} else {
+			// rejoining the set, the timer has yet to remove it
+			s.c.expireEntry(ent)
+		}
+	}
+
+	s.c.store(str, times+1, nil)
+	return times + 1, s.c.items[str].created
+}
+
+// Has reports whether str is a member of the set. It does not restart the
+// ttl of str.
+func (s *StringSet) Has(str string) bool {
+	_, ok := s.c.GetNoReset(str)
+	return ok
+}
+
+// Remove removes str from the set. Returns true if it was a member.
+func (s *StringSet) Remove(str string) bool {
+	return s.c.Del(str)
+}
+
+// Len returns the number of strings in the set
+func (s *StringSet) Len() int {
+	return s.c.Len()
+}
@@ -0,0 +1,56 @@
+package ttlru
+
+// shrinkMinPeak is the smallest number of entries a cache must have held
+// before it is automatically shrunk. Below it, reallocating costs more than
+// the memory it returns.
+const shrinkMinPeak = 1024
+
+// WithAutoShrink shrinks the cache, as Shrink does, whenever the number of
+// entries drops below a quarter of the most it held since it was last shrunk.
+// Purge also releases the memory of the purged entries rather than keeping it
+// for reuse.
+func WithAutoShrink() Option {
+	return func(c *cache) error {
+		c.autoShrink = true
+		return nil
+	}
+}
+
+func (c *cache) Shrink() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shrink()
+}
+
+func (c *cache) shrink() {
+	// must already have a write lock
+
+	items := make(map[interface{}]*entry, len(c.items))
+	for k, v := range c.items {
+		items[k] = v
+	}
+	c.items = items
+	c.compactOrder()
+
+	// the heaps are replaced in place, so entries keep pointing at the right
+	// heap, and at the right index in it
+	for _, h := range c.heaps() {
+		h.shrink()
+	}
+
+	c.peak = len(c.items)
+}
+
+func (c *cache) maybeShrink() {
+	// must already have a write lock
+
+	if !c.autoShrink {
+		return
+	}
+
+	if n := len(c.items); n > c.peak {
+		c.peak = n
+	} else if c.peak >= shrinkMinPeak && n < c.peak/4 {
+		c.shrink()
+	}
+}
@@ -0,0 +1,46 @@
+package ttlru
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrShutdown is returned by TrySet once the cache has been shut down
+var ErrShutdown = errors.New("ttlru: cache is shut down")
+
+// Shutdown stops the cache from accepting new values, waits for any changes
+// to the spill from WithSpill to be made, and then closes the cache. Items
+// already cached can still be read or removed. If ctx is done first its error
+// is returned, and the cache is closed without waiting any longer.
+func (c *cache) Shutdown(ctx context.Context) error {
+	c.lock.Lock()
+	c.shutdown = true
+	c.lock.Unlock()
+
+	defer c.Close()
+
+	if c.spill == nil {
+		return nil
+	}
+
+	// caches without timers never start goroutines
+	if c.lazy {
+		c.spillLock.Lock()
+		c.spillLock.Unlock()
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		c.spillLock.Lock()
+		c.spillLock.Unlock()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,148 @@
+package ttlru
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Spill is a second level store, typically on disk, for entries evicted from
+// a cache to make room for others. Implementations are responsible for
+// bounding their own size and may drop entries at any time. Calls are
+// serialized by the cache, but are made without holding its lock.
+type Spill interface {
+	// Put stores value for key until expires. A zero expires means the
+	// value never expires.
+	Put(key, value interface{}, expires time.Time)
+
+	// Get returns the value stored for key and when it expires
+	Get(key interface{}) (value interface{}, expires time.Time, ok bool)
+
+	// Del removes key, if present
+	Del(key interface{})
+
+	// Purge removes all keys
+	Purge()
+}
+
+// WithSpill moves entries evicted for capacity into s rather than discarding
+// them. When Get or GetNoReset miss, s is consulted before declaring a miss,
+// and any live value found there is moved back into the cache. Entries that
+// expire, or are removed by Del or Purge, are not spilled.
+func WithSpill(s Spill) Option {
+	return func(c *cache) error {
+		if c.running {
+			return errRunning("WithSpill")
+		}
+		c.spill = s
+		return nil
+	}
+}
+
+// spillOp is a change to the spill that is queued while holding the lock and
+// made once it is released
+type spillOp struct {
+	kind    OpKind
+	key     interface{}
+	value   interface{}
+	expires time.Time
+}
+
+func (c *cache) queueSpill(op spillOp) {
+	// must already have a write lock
+
+	if c.spill == nil {
+		return
+	}
+
+	c.spillOps = append(c.spillOps, op)
+	c.spillGen++
+}
+
+func (c *cache) spillEntry(e *entry) {
+	// must already have a write lock
+
+	var expires time.Time
+	if e.ttl > 0 {
+		expires = e.expires
+	}
+
+	c.queueSpill(spillOp{kind: OpSet, key: e.key, value: e.value, expires: expires})
+}
+
+func (c *cache) flushSpill(ops []spillOp) {
+	// must already hold spillLock, but not the cache lock
+
+	defer c.spillLock.Unlock()
+
+	for _, op := range ops {
+		switch op.kind {
+		case OpSet:
+			c.spill.Put(op.key, op.value, op.expires)
+		case OpDel:
+			c.spill.Del(op.key)
+		case OpPurge:
+			c.spill.Purge()
+		}
+	}
+}
+
+// lookup returns the value of key, consulting the spill if it is not cached
+func (c *cache) lookup(key interface{}, reset, view bool) (interface{}, bool) {
+	c.lock.Lock()
+
+	// NoReset may be changed by Configure, so it is only read under the lock
+	reset = reset && !c.NoReset
+
+	if ent := c.access(key, reset, view); ent != nil {
+		value, ok := c.plain(ent.value)
+		c.unlock()
+		return value, ok
+	}
+
+	if c.spill == nil {
+		c.lock.Unlock()
+		return nil, false
+	}
+
+	gen := c.spillGen
+	c.lock.Unlock()
+
+	c.spillLock.Lock()
+	value, expires, ok := c.spill.Get(key)
+	c.spillLock.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	if !expires.IsZero() && !c.clock().Before(expires) {
+		return nil, false
+	}
+
+	if c.shutdown {
+		return c.plain(value)
+	}
+
+	// the spill changed while it was read, so the key may since have been
+	// set or deleted; the value read is still returned, but is left in the
+	// spill rather than risk resurrecting it
+	if c.spillGen != gen {
+		if ent := c.access(key, reset, view); ent != nil {
+			value = ent.value
+		}
+		return c.plain(value)
+	}
+
+	// inserting the entry removes it from the spill
+	ent, _ := c.set(key, value, c.storedTTL(key, value), nil)
+	if !reset && ent.ttl > 0 && !expires.IsZero() {
+		ent.expires = expires
+		c.armEntry(ent)
+		heap.Fix(ent.heap, ent.index)
+	}
+
+	return c.plain(value)
+}
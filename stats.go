@@ -0,0 +1,264 @@
+package ttlru
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// pressureWindow is the sliding window over which eviction pressure is
+// measured, in one second buckets
+const pressureWindow = 60
+
+// Stats describes the recent behavior of a cache
+type Stats struct {
+	// Sets is the number of items set over the last minute
+	Sets uint64
+
+	// Evictions is the number of items evicted over the last minute to make
+	// room for others
+	Evictions uint64
+
+	// EvictionRate is the average number of Evictions per second, over the
+	// last minute or the life of the cache if it is younger
+	EvictionRate float64
+
+	// EvictionsPerThousandSets is the number of Evictions for every thousand
+	// Sets, a measure of how undersized the cache is that does not depend on
+	// its load
+	EvictionsPerThousandSets float64
+
+	// CostP50, CostP90 and CostP99 are the median, 90th and 99th percentile
+	// costs of the items in the cache, as computed by the function given to
+	// WithCostFunc. They are tracked in power of two buckets and rounded up
+	// to the largest cost of their bucket, one less than a power of two, so
+	// they are only accurate to within a factor of two. Costs can be measured
+	// without bounding them with WithMaxCost(math.MaxInt64).
+	CostP50, CostP90, CostP99 int64
+
+	// RemainingTTL holds the deciles of the time remaining until the live
+	// items in the cache expire: RemainingTTL[i] is the 10*i-th percentile,
+	// from the soonest expiring item at 0 to the last at 10. Items that never
+	// expire are left out, and it is all zero if none do.
+	RemainingTTL [11]time.Duration
+
+	// OldestAge is how long ago the oldest item in the cache was added. An
+	// age far beyond the TTL suggests items are being kept alive by
+	// accesses, or never expire.
+	OldestAge time.Duration
+}
+
+// WithOldestAgeAlert starts a watcher that checks the age of the oldest item
+// in the cache every interval, and calls fn with it whenever it first exceeds
+// threshold. fn is not called again until the age has dropped back below
+// threshold. The watcher runs until Close is called.
+func WithOldestAgeAlert(threshold, interval time.Duration, fn func(age time.Duration)) Option {
+	return func(c *cache) error {
+		if threshold <= 0 {
+			return fmt.Errorf("ttlru: oldest age threshold %v is not positive", threshold)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("ttlru: oldest age watch interval %v is not positive", interval)
+		}
+		if c.running {
+			return errRunning("WithOldestAgeAlert")
+		}
+		c.ageThreshold = threshold
+		c.ageInterval = interval
+		c.onOldAge = fn
+		return nil
+	}
+}
+
+func (c *cache) watchAge() {
+	ticker := time.NewTicker(c.ageInterval)
+	defer ticker.Stop()
+
+	var alerted bool
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.lock.RLock()
+		age := c.oldestAge()
+		c.lock.RUnlock()
+
+		old := age > c.ageThreshold
+		if old && !alerted {
+			c.onOldAge(age)
+		}
+		alerted = old
+	}
+}
+
+// oldestAge returns the age of the oldest live item
+func (c *cache) oldestAge() time.Duration {
+	// must already have a read lock
+
+	now := c.clock()
+
+	var oldest *entry
+	for _, e := range c.items {
+		if e.live(now) && (oldest == nil || e.created.Before(oldest.created)) {
+			oldest = e
+		}
+	}
+
+	if oldest == nil {
+		return 0
+	}
+
+	return time.Since(oldest.created)
+}
+
+// costBuckets is the number of buckets of the cost histogram: one for costs
+// up to zero, and one for each power of two
+const costBuckets = 65
+
+// addCost accounts for the cost of e, newly held by the cache
+func (c *cache) addCost(e *entry) {
+	// must already have a write lock
+
+	c.cost += e.cost
+	c.costs[costBucket(e.cost)]++
+}
+
+// subCost accounts for the cost of e, no longer held by the cache
+func (c *cache) subCost(e *entry) {
+	// must already have a write lock
+
+	c.cost -= e.cost
+	c.costs[costBucket(e.cost)]--
+}
+
+// costBucket returns the histogram bucket of cost, so that bucket i holds the
+// costs from 1<<(i-1) to 1<<i - 1
+func costBucket(cost int64) int {
+	if cost <= 0 {
+		return 0
+	}
+	return bits.Len64(uint64(cost))
+}
+
+// costPercentile returns the largest cost of the histogram bucket holding the
+// item at percentile p of the items in the cache
+func (c *cache) costPercentile(p float64) int64 {
+	// must already have a read lock
+
+	if len(c.items) == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p / 100 * float64(len(c.items))))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, n := range c.costs {
+		if seen += n; seen < rank {
+			continue
+		}
+
+		switch {
+		case i == 0:
+			return 0
+		case i >= 63:
+			return math.MaxInt64
+		}
+		return 1<<uint(i) - 1
+	}
+
+	return math.MaxInt64
+}
+
+// remainingDeciles returns the deciles of the remaining TTLs of the live
+// items that expire
+func (c *cache) remainingDeciles() [11]time.Duration {
+	// must already have a read lock
+
+	var deciles [11]time.Duration
+
+	now := c.clock()
+
+	remaining := make([]time.Duration, 0, len(c.items))
+	for _, e := range c.items {
+		if e.ttl > 0 && e.live(now) {
+			remaining = append(remaining, e.expires.Sub(now))
+		}
+	}
+
+	if len(remaining) == 0 {
+		return deciles
+	}
+
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i] < remaining[j]
+	})
+
+	for i := range deciles {
+		deciles[i] = remaining[i*(len(remaining)-1)/10]
+	}
+
+	return deciles
+}
+
+// pressure counts the sets and evictions during one second
+type pressure struct {
+	second    int64
+	sets      uint64
+	evictions uint64
+}
+
+// bucket returns the pressure bucket for the current second
+func (c *cache) bucket() *pressure {
+	// must already have a write lock
+
+	now := time.Now().Unix()
+	b := &c.pressure[now%pressureWindow]
+	if b.second != now {
+		*b = pressure{second: now}
+	}
+
+	return b
+}
+
+func (c *cache) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var s Stats
+
+	now := time.Now()
+	for _, b := range c.pressure {
+		if now.Unix()-b.second < pressureWindow {
+			s.Sets += b.sets
+			s.Evictions += b.evictions
+		}
+	}
+
+	elapsed := now.Sub(c.born)
+	if elapsed > pressureWindow*time.Second {
+		elapsed = pressureWindow * time.Second
+	}
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+
+	s.OldestAge = c.oldestAge()
+	s.CostP50 = c.costPercentile(50)
+	s.CostP90 = c.costPercentile(90)
+	s.CostP99 = c.costPercentile(99)
+	s.RemainingTTL = c.remainingDeciles()
+	s.EvictionRate = float64(s.Evictions) / elapsed.Seconds()
+	if s.Sets > 0 {
+		s.EvictionsPerThousandSets = 1000 * float64(s.Evictions) / float64(s.Sets)
+	}
+
+	return s
+}
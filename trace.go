@@ -0,0 +1,93 @@
+package ttlru
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// TraceOutcome is the kind of operation, and its outcome, a TraceEvent records
+type TraceOutcome int
+
+const (
+	// TraceHit records a Get that found its key
+	TraceHit TraceOutcome = iota
+
+	// TraceMiss records a Get that did not find its key
+	TraceMiss
+
+	// TraceSet records a Set
+	TraceSet
+
+	// TraceDel records a Del
+	TraceDel
+)
+
+// TraceEvent describes a single operation sampled by WithSampledTrace
+type TraceEvent struct {
+	Key     interface{}
+	Outcome TraceOutcome
+
+	// Latency is how long the operation took, including waiting for the lock
+	Latency time.Duration
+
+	// TTL is the time remaining until the key expires after the operation,
+	// or zero if it is not cached or never expires
+	TTL time.Duration
+}
+
+// WithSampledTrace calls fn with a TraceEvent for a random fraction rate of
+// the calls to Get, GetNoReset, Set and Del. fn is called without holding any
+// lock on the cache, in the goroutine of the operation, so it should hand the
+// event off rather than block.
+func WithSampledTrace(rate float64, fn func(TraceEvent)) Option {
+	return func(c *cache) error {
+		if rate <= 0 || rate > 1 {
+			return fmt.Errorf("ttlru: trace sample rate %v is not in (0, 1]", rate)
+		}
+		if c.running {
+			return errRunning("WithSampledTrace")
+		}
+		c.traceRate = rate
+		c.tracer = fn
+		return nil
+	}
+}
+
+// sample returns the start time of an operation if it is to be traced, and
+// the zero time otherwise
+func (c *cache) sample() time.Time {
+	if c.tracer == nil || rand.Float64() >= c.traceRate {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// trace reports an operation on key that started at start, if it was sampled
+func (c *cache) trace(key interface{}, outcome TraceOutcome, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+
+	ev := TraceEvent{
+		Key:     key,
+		Outcome: outcome,
+		Latency: time.Since(start),
+	}
+
+	c.lock.RLock()
+	if ent, ok := c.items[key]; ok && ent.ttl > 0 && ent.live(c.clock()) {
+		ev.TTL = ent.expires.Sub(c.clock())
+	}
+	c.lock.RUnlock()
+
+	c.tracer(ev)
+}
+
+// hitOrMiss returns the outcome of a Get that found its key if ok is set
+func hitOrMiss(ok bool) TraceOutcome {
+	if ok {
+		return TraceHit
+	}
+	return TraceMiss
+}
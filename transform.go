@@ -0,0 +1,89 @@
+package ttlru
+
+// WithValueTransform stores every value set in the cache as encoded by encode,
+// and decodes it with decode whenever it is handed back: by the getters,
+// AppendValues, Entries, Acquire, WithLockedValue, the Expired channel and the
+// callbacks. Values can so be kept encrypted, compressed or normalized while
+// cached. A value that fails to encode is not set, and TrySet returns the
+// error.
+//
+// Values that fail to decode read as misses, and TryGet returns the error.
+// AppendValues leaves them out, while Entries and the callbacks have them as
+// nil. Ops, the Spill and the cost function deal in encoded values, so the op
+// log of a cache can be applied to another with the same transform, while the
+// TTL function is given the plain value. Both functions may be called with the
+// cache locked and must not use it.
+func WithValueTransform(encode, decode func(value interface{}) (interface{}, error)) Option {
+	return func(c *cache) error {
+		if c.running {
+			return errRunning("WithValueTransform")
+		}
+		c.encode, c.decode = encode, decode
+		return nil
+	}
+}
+
+// encodeValue returns value as it is to be stored
+func (c *cache) encodeValue(value interface{}) (interface{}, error) {
+	if c.encode == nil {
+		return value, nil
+	}
+	return c.encode(value)
+}
+
+// decodeValue returns the value that was stored as value
+func (c *cache) decodeValue(value interface{}) (interface{}, error) {
+	if c.decode == nil {
+		return value, nil
+	}
+	return c.decode(value)
+}
+
+// plain returns the value that was stored as value, and whether it could be
+// decoded
+func (c *cache) plain(value interface{}) (interface{}, bool) {
+	value, err := c.decodeValue(value)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// decoded returns the value that was stored as value, or nil if it can not be
+// decoded
+func (c *cache) decoded(value interface{}) interface{} {
+	value, err := c.decodeValue(value)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// appendValue appends the value stored as value to dst, unless it can not be
+// decoded
+func (c *cache) appendValue(dst []interface{}, value interface{}) []interface{} {
+	if value, err := c.decodeValue(value); err == nil {
+		dst = append(dst, value)
+	}
+	return dst
+}
+
+// merge merges the stored values local and remote with the merge function of
+// the cache, reporting whether they could be decoded and the result encoded
+func (c *cache) merge(key, local, remote interface{}) (interface{}, bool) {
+	local, lok := c.plain(local)
+	remote, rok := c.plain(remote)
+	if !lok || !rok {
+		return nil, false
+	}
+
+	value, err := c.encodeValue(c.mergeFunc(key, local, remote))
+	return value, err == nil
+}
+
+// export returns e as an Entry with its value decoded
+func (c *cache) export(e *entry) Entry {
+	ent := e.export()
+	ent.Value = c.decoded(ent.Value)
+	return ent
+}
@@ -10,7 +10,7 @@ func (h ttlHeap) Less(i, j int) bool {
 	if i == j || i < 0 || j < 0 {
 		return false
 	}
-	return h[i].expires.Before(h[j].expires)
+	return h[i].expiresBefore(h[j])
 }
 
 func (h ttlHeap) Swap(i, j int) {
@@ -39,3 +39,10 @@ func (h *ttlHeap) Pop() interface{} {
 	*h = old[0 : n-1]
 	return item
 }
+
+// shrink reallocates the heap to fit its current length
+func (h *ttlHeap) shrink() {
+	s := make(ttlHeap, len(*h))
+	copy(s, *h)
+	*h = s
+}
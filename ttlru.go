@@ -13,30 +13,227 @@ package ttlru // import "zvelo.io/ttlru"
 
 import (
 	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type entry struct {
-	key     interface{}
-	value   interface{}
-	index   int
-	expires time.Time
-	timer   *time.Timer
+	key      interface{}
+	value    interface{}
+	index    int
+	heap     *ttlHeap
+	hits     int
+	seq      uint64
+	ttl      time.Duration
+	cost     int64
+	stamp    time.Time
+	created  time.Time
+	updated  time.Time
+	accessed time.Time
+	expires  time.Time
+	timer    *time.Timer
+	tick     *tick
+	sum      uint32
+	onExpire func(key, value interface{})
+	visible  time.Time
+	uses     int
+	low      bool
+	resident time.Duration
+	meta     interface{}
+	ref      *ref
+	version  uint64
+	mu       *sync.Mutex
+}
+
+// Entry is a key and value pair held by the cache
+type Entry struct {
+	Key   interface{}
+	Value interface{}
+
+	// CreatedAt is when the key was added to the cache
+	CreatedAt time.Time
+
+	// LastAccessedAt is when the key was last retrieved with Get, or when it
+	// was added if it never was
+	LastAccessedAt time.Time
+
+	// Meta is the metadata stored with the value by SetWithMeta, if any
+	Meta interface{}
+}
+
+func (e *entry) export() Entry {
+	return Entry{
+		Key:            e.key,
+		Value:          e.value,
+		CreatedAt:      e.created,
+		LastAccessedAt: e.accessed,
+		Meta:           e.meta,
+	}
+}
+
+func (e *entry) apply(opts []SetOption) {
+	for _, opt := range opts {
+		opt(e)
+	}
+}
+
+// evictable reports whether the entry may be evicted at now to make room for
+// keep. Unless resident is set, the minimum residency of the entry is ignored.
+func (e *entry) evictable(keep *entry, now time.Time, resident bool) bool {
+	return e != keep && !e.leased() && (!resident || now.Sub(e.updated) >= e.resident)
+}
+
+// expiresBefore reports whether the entry expires before o. Entries that
+// never expire come after all those that do, the oldest first.
+func (e *entry) expiresBefore(o *entry) bool {
+	if (e.ttl <= 0) != (o.ttl <= 0) {
+		return o.ttl <= 0
+	}
+	return e.expires.Before(o.expires)
+}
+
+// leased reports whether the current value of the entry is leased
+func (e *entry) leased() bool {
+	return e.ref != nil && e.ref.count > 0
+}
+
+// clock returns the time entries expire relative to. It stands still while
+// the cache is paused.
+func (c *cache) clock() time.Time {
+	if c.paused() {
+		return c.pausedAt
+	}
+	return c.now()
+}
+
+// now returns the current time, without its monotonic clock reading if
+// WithWallClock is set
+func (c *cache) now() time.Time {
+	if c.wallClock {
+		return time.Now().Round(0)
+	}
+	return time.Now()
+}
+
+func (c *cache) paused() bool {
+	return !c.pausedAt.IsZero()
+}
+
+// live reports whether the entry is visible and has not yet expired at now
+func (e *entry) live(now time.Time) bool {
+	return !now.Before(e.visible) && !e.dead(now)
+}
+
+// dead reports whether the entry has expired at now
+func (e *entry) dead(now time.Time) bool {
+	return e.ttl != 0 && !now.Before(e.expires)
 }
 
 type Cache interface {
 	// Set a key with value to the cache. Returns true if an item was
 	// evicted.
-	Set(key, value interface{}) bool
+	Set(key, value interface{}, opts ...SetOption) bool
+
+	// TrySet is like Set, but returns an error wrapping ErrEntryTooCostly,
+	// rather than silently ignoring the value, if it costs more than allowed
+	// by WithMaxEntryCost
+	TrySet(key, value interface{}, opts ...SetOption) (bool, error)
+
+	// SetIfNewer sets a key with value to the cache only if ts is newer than
+	// the timestamp of the existing item. Items added with Set have no
+	// timestamp, so they are always overwritten. Returns true if the value
+	// was stored.
+	SetIfNewer(key, value interface{}, ts time.Time, opts ...SetOption) bool
+
+	// SetWithMeta is like Set, but stores meta alongside value. The metadata
+	// plays no part in eviction, and is dropped by the next Set of key.
+	SetWithMeta(key, value, meta interface{}, opts ...SetOption) bool
 
 	// Get an item from the cache by key. Returns the value if it exists,
 	// and a bool stating whether or not it existed.
 	Get(key interface{}) (interface{}, bool)
 
-	// Keys returns a slice of all the keys in the cache
+	// TryGet is like Get, but returns ErrChecksum if the value was found to be
+	// corrupted by WithChecksum
+	TryGet(key interface{}) (interface{}, bool, error)
+
+	// GetNoReset is like Get, but never resets the TTL of the item, even when
+	// the cache resets TTLs on access
+	GetNoReset(key interface{}) (interface{}, bool)
+
+	// Peek returns the value of key without any of the side effects of Get.
+	// The item is not counted as accessed, its TTL is not reset and its
+	// place in the eviction order is left as it was.
+	Peek(key interface{}) (interface{}, bool)
+
+	// Contains reports whether the cache holds a live item for key, without
+	// reading its value or counting it as an access. The parent of a scoped
+	// cache is not consulted.
+	Contains(key interface{}) bool
+
+	// SetAt is like Set, but the item is not returned, or counted as an
+	// access, before visibleAt. Its TTL starts once it becomes visible.
+	SetAt(key, value interface{}, visibleAt time.Time, opts ...SetOption) bool
+
+	// SetWithTTL is like Set, but the item expires after ttl rather than the
+	// TTL of the cache, still within any WithTTLBounds. A non-positive ttl
+	// never expires. The ttl is kept, including when it is reset by an
+	// access, until the item is set again.
+	SetWithTTL(key, value interface{}, ttl time.Duration, opts ...SetOption) bool
+
+	// GetFresh is like Get, but treats items last set more than maxAge ago as
+	// misses, without counting them as accessed
+	GetFresh(key interface{}, maxAge time.Duration) (interface{}, bool)
+
+	// GetWithMeta is like Get, but also returns the metadata stored with the
+	// value by SetWithMeta, or nil if there is none
+	GetWithMeta(key interface{}) (value, meta interface{}, ok bool)
+
+	// GetWithExpiration is like Get, but also returns when the item expires,
+	// after any reset of its TTL by this access, or the zero time if it never
+	// does
+	GetWithExpiration(key interface{}) (interface{}, time.Time, bool)
+
+	// Lookup is like Get for each of keys, returning a Result for every key
+	// in the same order
+	Lookup(keys []interface{}) []Result
+
+	// WithLockedValue calls fn with a pointer to the value of key while
+	// holding a lock on that item only, so that calls for the same key are
+	// serialized without blocking the rest of the cache. fn may modify the
+	// value it points to in place, or replace it, in which case it is stored
+	// as if by Set unless the key was set by other means while fn ran. The
+	// value is leased while fn runs, as if by Acquire. It counts as an
+	// access. Returns false, without calling fn, if the item did not exist or
+	// was removed before fn could run.
+	WithLockedValue(key interface{}, fn func(value *interface{})) bool
+
+	// Keys returns a slice of all the keys in the cache, in the order set by
+	// WithKeyOrder
 	Keys() []interface{}
 
+	// AppendKeys appends the keys in the cache to dst, in the order set by
+	// WithKeyOrder, and returns the extended slice. Reusing dst across calls
+	// avoids allocating a new slice each time when keys are unordered.
+	AppendKeys(dst []interface{}) []interface{}
+
+	// AppendValues is like AppendKeys, but for the values in the cache
+	AppendValues(dst []interface{}) []interface{}
+
+	// KeysPage returns up to limit keys, in insertion order, starting after
+	// cursor, along with the cursor of the next page. Pass an empty cursor to
+	// get the first page. The returned cursor is empty once there are no more
+	// keys. Keys added while paging are returned on later pages. Only limit
+	// keys are held in memory at a time, and a page costs time in proportion
+	// to limit rather than to the size of the cache.
+	KeysPage(cursor string, limit int) ([]interface{}, string)
+
 	// Len returns the number of items present in the cache
 	Len() int
 
@@ -49,174 +246,1449 @@ type Cache interface {
 	// Del deletes an item from the cache by key. Returns if an item was
 	// actually deleted.
 	Del(key interface{}) bool
+
+	// DelGet is like Del, but also returns the value of the deleted item
+	DelGet(key interface{}) (interface{}, bool)
+
+	// Fetch returns the value of key, or calls fn to load it if it is
+	// missing and sets it in the cache. Concurrent Fetches of a key that is
+	// missing share a single call of fn, as with Memoize. Errors are returned
+	// to every caller sharing the call, but are not cached.
+	Fetch(key interface{}, fn func() (interface{}, error)) (interface{}, error)
+
+	// Rename moves the item at oldKey to newKey, replacing any item there,
+	// with the same value, metadata and expiration. Returns false if there
+	// was no item at oldKey, or newKey is within its WithTombstones window.
+	Rename(oldKey, newKey interface{}) bool
+
+	// Move removes the item at key from the cache and sets it in dst in one
+	// step, so that it is always found in one or the other. It keeps its
+	// expiration, creation time, metadata and expire callback. Returns false,
+	// leaving the item in place, if there was no item at key, it is leased
+	// with Acquire, or dst refuses it, as when dst is read only or shut down.
+	Move(key interface{}, dst Cache) bool
+
+	// Expired returns the channel expired entries are delivered to when the
+	// cache was created WithExpiredChannel. It returns nil otherwise.
+	Expired() <-chan Entry
+
+	// Age returns how long ago an item was added to the cache, regardless of
+	// any updates or accesses since, and a bool stating whether or not it
+	// existed. It does not count as an access.
+	Age(key interface{}) (time.Duration, bool)
+
+	// ExpiredOverflow returns the number of expired entries that were dropped
+	// because the channel returned by Expired was full
+	ExpiredOverflow() uint64
+
+	// GetEntry returns the entry for key, and a bool stating whether or not
+	// it existed. It does not count as an access.
+	GetEntry(key interface{}) (Entry, bool)
+
+	// Entries returns a slice of all the entries in the cache, in the order
+	// set by WithKeyOrder. It does not count as an access.
+	Entries() []Entry
+
+	// ExpiringWithin returns the entries that will expire within d, soonest
+	// first, without visiting those that expire later. It does not count as
+	// an access.
+	ExpiringWithin(d time.Duration) []Entry
+
+	// AppendEntries is like AppendKeys, but for the entries in the cache. It
+	// does not count as an access.
+	AppendEntries(dst []Entry) []Entry
+
+	// Oplog returns the channel mutations are delivered to when the cache was
+	// created WithOplog. It returns nil otherwise.
+	Oplog() <-chan Op
+
+	// OplogOverflow returns the number of ops that were dropped because the
+	// channel returned by Oplog was full
+	OplogOverflow() uint64
+
+	// Shrink reallocates the internal structures of the cache to fit the
+	// number of items it currently holds, releasing the memory left over from
+	// removed items
+	Shrink()
+
+	// Pause freezes the TTL of every item in the cache, including items set
+	// while paused, until Resume is called. Items do not expire while the
+	// cache is paused.
+	Pause()
+
+	// Resume restarts the TTLs frozen by Pause, extending every expiration by
+	// the time the cache was paused
+	Resume()
+
+	// Acquire gets an item from the cache by key, like Get, and leases it.
+	// The item is neither evicted nor expired until release is called, though
+	// it can still be deleted, replaced or purged. An item that expired while
+	// leased is removed when its last lease is released. release must be
+	// called exactly once; release is nil if the item did not exist.
+	Acquire(key interface{}) (value interface{}, release func(), ok bool)
+
+	// Configure applies opts to the cache while it is in use. Either all of
+	// the options are applied, or none are and an error is returned. Changes
+	// to the TTL apply to items as they are next set or reset. Options that
+	// set up background work or channels, or name the cache, can only be
+	// given to New.
+	Configure(opts ...Option) error
+
+	// Apply replays an op, received from the Oplog of another cache, on this
+	// one, resolving conflicts as set by WithLastWriteWins or WithMergeFunc.
+	// Without either, ops are applied as they come. Applied ops are not
+	// recorded in the Oplog of this cache, so caches can exchange ops in both
+	// directions. Returns true if the cache changed.
+	Apply(op Op) bool
+
+	// Warm stores the key/value pairs produced by src, without evicting
+	// anything, until src is exhausted, the cache is full or ctx is done
+	Warm(ctx context.Context, src func(yield func(key, value interface{}) bool)) error
+
+	// HeapDepth returns the number of items in the expiration heaps, which
+	// matches Len for a healthy cache
+	HeapDepth() int
+
+	// MapLen returns the number of items in the key map, which matches Len
+	MapLen() int
+
+	// ConsistencyReport checks that the key map, expiration heaps and timers
+	// of the cache agree with one another. It takes time proportional to the
+	// number of items, holding a read lock throughout.
+	ConsistencyReport() Consistency
+
+	// Stats returns the recent eviction pressure on the cache, and the age of
+	// its oldest item
+	Stats() Stats
+
+	// ReadOnly returns a view of the cache whose methods can not modify it.
+	// Those that would otherwise do so, including Close and Shutdown, do
+	// nothing and report ErrReadOnly where they return an error. Reads still
+	// count as accesses, but miss items set WithMaxUses rather than use them
+	// up. Acquire always misses, as a lease would keep the item from being
+	// evicted.
+	ReadOnly() Cache
+
+	// Close stops any background work started by the cache. The cache itself
+	// remains usable.
+	Close()
+
+	// Shutdown is like Close, but first stops the cache from accepting new
+	// values and waits, until ctx is done, for pending writes to any second
+	// level store to finish
+	Shutdown(ctx context.Context) error
+}
+
+// Option configures a cache as it is created. An Option returns an error if
+// its arguments are invalid.
+type Option func(*cache) error
+
+// SetOption configures a single entry as it is set. Options apply to the value
+// being set only, and are dropped when the key is set again.
+type SetOption func(*entry)
+
+// WithExpireCallback calls fn with the key and value of the entry when its TTL
+// elapses. It is not called if the entry is deleted, evicted or replaced
+// first. fn is called without holding any lock on the cache, so it may use the
+// cache itself.
+func WithExpireCallback(fn func(key, value interface{})) SetOption {
+	return func(e *entry) {
+		e.onExpire = fn
+	}
+}
+
+// WithMaxUses removes the entry once it has been returned n times by Get, or
+// any of the other methods that count as an access, if its TTL has not
+// elapsed first. Each read and the removal that may follow are atomic, so no
+// use is ever served twice. A non-positive n places no limit on the reads.
+// The limit is not in the oplog; the removal is, as a delete, so replicas
+// stop serving the entry once it is used up.
+func WithMaxUses(n int) SetOption {
+	return func(e *entry) {
+		e.uses = n
+	}
+}
+
+// WithMinResidency keeps the entry from being evicted to make room for others
+// until d has passed since it was set, so that entries that were expensive to
+// load are not evicted right away during bursts of sets. The entry still
+// expires when its TTL elapses. If every entry is within its minimum
+// residency the cache grows beyond its capacity rather than evict one, but
+// only up to twice its capacity, or maximum cost. Past that the soonest
+// expiring entry is evicted regardless of its residency.
+func WithMinResidency(d time.Duration) SetOption {
+	return func(e *entry) {
+		e.resident = d
+	}
+}
+
+// WithLowPriorityInsert marks a new entry as part of a scan, such as a bulk
+// load or backfill, that is unlikely to be read again. Until the entry is
+// read, it is evicted before any other entry, so a scan does not push out the
+// working set. It has no effect when updating an entry already in the cache.
+func WithLowPriorityInsert() SetOption {
+	return func(e *entry) {
+		e.low = true
+	}
+}
+
+// KeyOrder is the order Keys returns keys in
+type KeyOrder int
+
+const (
+	// UnorderedKeys returns keys in no particular order. It is the default and
+	// the cheapest order.
+	UnorderedKeys KeyOrder = iota
+
+	// InsertionOrder returns keys in the order they were first added to the
+	// cache, oldest first
+	InsertionOrder
+
+	// ExpirationOrder returns keys in the order they will expire, soonest
+	// first, and then those that never expire
+	ExpirationOrder
+)
+
+func WithTTL(val time.Duration) Option {
+	return func(c *cache) error {
+		if val < 0 {
+			return fmt.Errorf("ttlru: negative ttl %v", val)
+		}
+		c.ttl = val
+		return nil
+	}
+}
+
+// WithTTLFunc computes the TTL of each entry from its key and value whenever
+// it is set. The default TTL from WithTTL is used for entries when fn is nil.
+// A non-positive result means the entry never expires.
+func WithTTLFunc(fn func(key, value interface{}) time.Duration) Option {
+	return func(c *cache) error {
+		c.ttlFunc = fn
+		return nil
+	}
+}
+
+// WithTTLBounds clamps the TTL of every entry, whether the default from WithTTL
+// or one computed by WithTTLFunc, to between min and max. Entries that would
+// never expire are given max.
+func WithTTLBounds(min, max time.Duration) Option {
+	return func(c *cache) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("ttlru: ttl bounds [%v, %v] are not a positive range", min, max)
+		}
+		c.minTTL = min
+		c.maxTTL = max
+		return nil
+	}
+}
+
+// WithMaxCost bounds the total cost of all entries in the cache, in addition
+// to the number of entries. Entries are evicted, soonest expiring first, until
+// a new or updated entry fits. The cost of each entry is computed by the
+// function given to WithCostFunc, or is 1 if there is none.
+func WithMaxCost(val int64) Option {
+	return func(c *cache) error {
+		if val <= 0 {
+			return fmt.Errorf("ttlru: max cost %d is not positive", val)
+		}
+		c.maxCost = val
+		return nil
+	}
+}
+
+// WithMaxEntryCost rejects values costing more than val, rather than evicting
+// other entries to make room for them. Set ignores such values, while TrySet
+// reports them with ErrEntryTooCostly. It requires WithMaxCost.
+func WithMaxEntryCost(val int64) Option {
+	return func(c *cache) error {
+		if val <= 0 {
+			return fmt.Errorf("ttlru: max entry cost %d is not positive", val)
+		}
+		c.maxEntryCost = val
+		return nil
+	}
+}
+
+// ErrEntryTooCostly is returned by TrySet for values costing more than allowed
+// by WithMaxEntryCost
+var ErrEntryTooCostly = errors.New("ttlru: entry cost exceeds the maximum")
+
+// WithCostFunc computes the cost of each entry from its key and value whenever
+// it is set. It is only meaningful together with WithMaxCost.
+func WithCostFunc(fn func(key, value interface{}) int64) Option {
+	return func(c *cache) error {
+		c.costFunc = fn
+		return nil
+	}
+}
+
+// WithProtectedSegment splits the cache into a probationary and a protected
+// segment. Entries accessed more than hits times are promoted into the
+// protected segment, which holds at most size entries. Capacity evictions only
+// take from the protected segment once the probationary one is empty. When the
+// protected segment is full, its soonest expiring entry is demoted back to the
+// probationary segment to make room.
+func WithProtectedSegment(hits, size int) Option {
+	return func(c *cache) error {
+		if hits < 0 {
+			return fmt.Errorf("ttlru: negative protected segment hits %d", hits)
+		}
+		if size <= 0 {
+			return fmt.Errorf("ttlru: protected segment size %d is not positive", size)
+		}
+		if c.running {
+			return errRunning("WithProtectedSegment")
+		}
+		c.protectHits = hits
+		c.protectSize = size
+		return nil
+	}
+}
+
+// WithOnEvictBatch registers fn to be called with the entries that were
+// evicted from the cache, either because they expired, to make room for other
+// entries or by Purge. Entries removed together are delivered in a single
+// call. fn is called without holding any lock on the cache, so it may use the
+// cache itself.
+func WithOnEvictBatch(fn func(entries []Entry)) Option {
+	return func(c *cache) error {
+		c.onEvictBatch = fn
+		return nil
+	}
+}
+
+// WithExpiredChannel delivers entries to the channel returned by Expired when
+// their TTL elapses. The channel is buffered with size entries. When it is
+// full, expired entries are dropped and counted by ExpiredOverflow instead of
+// blocking the cache.
+func WithExpiredChannel(size int) Option {
+	return func(c *cache) error {
+		if size < 0 {
+			return fmt.Errorf("ttlru: negative expired channel size %d", size)
+		}
+		if c.running {
+			return errRunning("WithExpiredChannel")
+		}
+		c.expired = make(chan Entry, size)
+		return nil
+	}
+}
+
+// WithWallClock measures TTLs by the wall clock rather than the monotonic
+// clock. By default, TTLs are immune to the wall clock being stepped, such as
+// by NTP, but do not elapse while the machine is suspended. With
+// WithWallClock, time spent suspended counts, so entries that expired
+// meanwhile are not returned after resuming, but stepping the wall clock
+// expires entries early or late.
+func WithWallClock() Option {
+	return func(c *cache) error {
+		if c.running {
+			return errRunning("WithWallClock")
+		}
+		c.wallClock = true
+		return nil
+	}
+}
+
+// WithExpirySpread delays the removal of each expired entry by a random
+// duration of up to val, so that entries sharing an expiration instant have
+// their callbacks and Expired notifications spread over val rather than
+// delivered in a single burst. Entries are no longer returned once their TTL
+// elapses, but are counted by Len until they are removed.
+func WithExpirySpread(val time.Duration) Option {
+	return func(c *cache) error {
+		if val < 0 {
+			return fmt.Errorf("ttlru: negative expiry spread %v", val)
+		}
+		c.expirySpread = val
+		return nil
+	}
+}
+
+// WithKeyOrder sets the order Keys returns keys in
+func WithKeyOrder(order KeyOrder) Option {
+	return func(c *cache) error {
+		if order < UnorderedKeys || order > ExpirationOrder {
+			return fmt.Errorf("ttlru: unknown key order %d", order)
+		}
+		c.keyOrder = order
+		return nil
+	}
+}
+
+func WithoutReset() Option {
+	return func(c *cache) error {
+		c.NoReset = true
+		return nil
+	}
+}
+
+// cache is the type that implements the ttlru
+type cache struct {
+	name     string
+	cap      int
+	ttl      time.Duration
+	ttlFunc  func(key, value interface{}) time.Duration
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	maxCost  int64
+	cost     int64
+	costs    [costBuckets]uint64
+	costFunc func(key, value interface{}) int64
+	items    map[interface{}]*entry
+	heap     *ttlHeap
+
+	// scan holds the entries set WithLowPriorityInsert that were not read
+	// since
+	scan *ttlHeap
+
+	protected   *ttlHeap
+	protectHits int
+	protectSize int
+
+	maxEntryCost int64
+
+	onEvictBatch func(entries []Entry)
+	evicted      []Entry
+
+	expired          chan Entry
+	expiredOverflow  uint64
+	expiredCallbacks []*entry
+	expirySpread     time.Duration
+	wallClock        bool
+	checksum         bool
+	encode           func(value interface{}) (interface{}, error)
+	decode           func(value interface{}) (interface{}, error)
+	traceRate        float64
+	tracer           func(TraceEvent)
+	granularity      time.Duration
+	ticks            map[int64]*tick
+
+	oplog         chan Op
+	oplogOverflow uint64
+
+	keyOrder KeyOrder
+	seq      uint64
+
+	// order holds the entries in insertion order, for KeysPage. Removed
+	// entries are dropped from it lazily.
+	order []*entry
+
+	shedThreshold float64
+	shedFraction  float64
+	shedInterval  time.Duration
+
+	autoShrink bool
+	peak       int
+
+	pausedAt time.Time
+
+	lww             bool
+	tombstones      map[interface{}]time.Time
+	tombstoneKeys   []interface{}
+	tombstoneWindow time.Duration
+	loadCooldown    time.Duration
+	cooling         map[interface{}]time.Time
+	coolingKeys     []interface{}
+	purgeStamp      time.Time
+	mergeFunc       func(key, local, remote interface{}) interface{}
+
+	leaseRefresh bool
+	destructor   func(key, value interface{})
+	destroyed    []Entry
+
+	spill     Spill
+	spillOps  []spillOp
+	spillGen  uint64
+	spillLock sync.Mutex
+
+	born     time.Time
+	pressure [pressureWindow]pressure
+
+	ageThreshold time.Duration
+	ageInterval  time.Duration
+	onOldAge     func(age time.Duration)
+
+	lazy   bool
+	parent Cache
+
+	// id orders the locks of caches that are locked together
+	id uint64
+
+	// fetches coalesces the loads of Fetch
+	fetches *loader
+
+	running   bool
+	shutdown  bool
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lock    sync.RWMutex
+	NoReset bool
+}
+
+// New creates a new Cache with cap entries that expire after ttl has
+// elapsed since the item was added, modified or accessed. It returns nil if
+// cap is not positive or any of the options are invalid.
+func New(cap int, opts ...Option) Cache {
+	c, err := NewWithError(cap, opts...)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// NewWithError is like New, but returns an error describing why cap or the
+// options are invalid, rather than nil.
+func NewWithError(cap int, opts ...Option) (Cache, error) {
+	if cap <= 0 {
+		return nil, fmt.Errorf("ttlru: capacity %d is not positive", cap)
+	}
+
+	c := cache{cap: cap}
+
+	c.lazy = notimers
+
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	c.items = make(map[interface{}]*entry, cap)
+
+	c.resetHeaps(c.cap)
+
+	// no need to init the heap as there are no items yet
+
+	c.done = make(chan struct{})
+
+	if c.shedInterval > 0 {
+		go c.do("memory", c.watchMemory)
+	}
+
+	if c.ageInterval > 0 {
+		go c.do("age", c.watchAge)
+	}
+
+	c.id = atomic.AddUint64(&cacheIDs, 1)
+	c.fetches = newLoader(&c)
+	c.born = time.Now()
+	c.running = true
+
+	return &c, nil
+}
+
+// validate checks that the options of the cache are consistent with each other
+func (c *cache) validate() error {
+	if c.costFunc != nil && c.maxCost == 0 {
+		return errors.New("ttlru: WithCostFunc requires WithMaxCost")
+	}
+
+	if c.maxEntryCost > 0 && c.maxCost == 0 {
+		return errors.New("ttlru: WithMaxEntryCost requires WithMaxCost")
+	}
+
+	if c.lazy && c.shedInterval > 0 {
+		return errors.New("ttlru: WithMemoryLimitShedding can not be used WithoutTimers")
+	}
+
+	if c.lazy && c.ageInterval > 0 {
+		return errors.New("ttlru: WithOldestAgeAlert can not be used WithoutTimers")
+	}
+
+	if c.protectSize >= c.cap {
+		return fmt.Errorf("ttlru: protected segment size %d is not smaller than the capacity %d", c.protectSize, c.cap)
+	}
+
+	return nil
+}
+
+func (c *cache) Set(key, value interface{}, opts ...SetOption) bool {
+	defer c.trace(key, TraceSet, c.sample())
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	evicted, _ := c.store(key, value, opts)
+	return evicted
+}
+
+func (c *cache) SetAt(key, value interface{}, visibleAt time.Time, opts ...SetOption) bool {
+	defer c.trace(key, TraceSet, c.sample())
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	// never append to the backing array of the caller's options
+	opts = append(opts[:len(opts):len(opts)], func(e *entry) {
+		e.visible = visibleAt
+	})
+
+	evicted, _ := c.storeOp(Op{Key: key, Value: value, VisibleAt: visibleAt}, opts)
+	return evicted
+}
+
+func (c *cache) SetWithTTL(key, value interface{}, ttl time.Duration, opts ...SetOption) bool {
+	defer c.trace(key, TraceSet, c.sample())
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	ttl = c.boundTTL(ttl)
+	opts = append(opts[:len(opts):len(opts)], func(e *entry) {
+		e.ttl = ttl
+	})
+
+	evicted, _ := c.storeOp(Op{Key: key, Value: value, TTL: opTTL(ttl)}, opts)
+	return evicted
+}
+
+func (c *cache) TrySet(key, value interface{}, opts ...SetOption) (bool, error) {
+	defer c.trace(key, TraceSet, c.sample())
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	return c.store(key, value, opts)
+}
+
+// store does the work of Set
+func (c *cache) store(key, value interface{}, opts []SetOption) (bool, error) {
+	// must already have a write lock
+
+	return c.storeOp(Op{Key: key, Value: value}, opts)
+}
+
+// storeOp is store for the set recorded by op, which is what is emitted to
+// the oplog
+func (c *cache) storeOp(op Op, opts []SetOption) (bool, error) {
+	// must already have a write lock
+
+	value, err := c.encodeValue(op.Value)
+	if err != nil {
+		return false, err
+	}
+
+	plain := op.Value
+	op.Value = value
+	return c.storeEncoded(op, plain, opts)
+}
+
+// storeEncoded is storeOp for a value that is already encoded, from plain
+func (c *cache) storeEncoded(op Op, plain interface{}, opts []SetOption) (bool, error) {
+	// must already have a write lock
+
+	key, value := op.Key, op.Value
+
+	if c.shutdown {
+		return false, ErrShutdown
+	}
+
+	if c.mourning(key) {
+		return false, nil
+	}
+
+	if err := c.checkCost(key, value); err != nil {
+		return false, err
+	}
+
+	var stamp time.Time
+	if c.lww {
+		stamp = c.nextStamp(key)
+	}
+
+	ent, evicted := c.set(key, value, c.entryTTL(key, plain), opts)
+	ent.stamp = stamp
+	delete(c.tombstones, key)
+
+	op.Kind, op.Stamp = OpSet, stamp
+	c.emit(op)
+
+	return evicted, nil
+}
+
+func (c *cache) checkCost(key, value interface{}) error {
+	if c.maxEntryCost <= 0 {
+		return nil
+	}
+
+	if cost := c.entryCost(key, value); cost > c.maxEntryCost {
+		return fmt.Errorf("%w: %d > %d", ErrEntryTooCostly, cost, c.maxEntryCost)
+	}
+
+	return nil
+}
+
+func (c *cache) SetIfNewer(key, value interface{}, ts time.Time, opts ...SetOption) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if ent, ok := c.items[key]; c.shutdown || (ok && !ts.After(ent.stamp)) || c.mourning(key) {
+		return false
+	}
+
+	// a replica applying the op would reject it for a later delete too
+	if c.lww && c.buried(key, ts) {
+		return false
+	}
+
+	plain := value
+	value, err := c.encodeValue(value)
+	if err != nil || c.checkCost(key, value) != nil {
+		return false
+	}
+
+	ent, _ := c.set(key, value, c.entryTTL(key, plain), opts)
+	ent.stamp = ts
+	delete(c.tombstones, key)
+	c.emit(Op{Kind: OpSet, Key: key, Value: value, Stamp: ts})
+
+	return true
+}
+
+// set sets key to the encoded value, with the ttl computed from its plain
+// value, unless overridden by opts
+func (c *cache) set(key, value interface{}, ttl time.Duration, opts []SetOption) (*entry, bool) {
+	// must already have a write lock
+
+	c.bucket().sets++
+
+	if c.lazy {
+		c.reap()
+	}
+
+	// Check for existing item
+	if ent, ok := c.items[key]; ok {
+		c.updateEntry(ent, value, ttl, opts)
+
+		// the new value may cost more than the old one
+		return ent, c.evict(ent)
+	}
+
+	ent := c.insertEntry(key, value, ttl, opts)
+
+	// Evict soonest expiring entries if the new entry exceeded capacity
+	return ent, c.evict(ent)
+}
+
+func (c *cache) evict(keep *entry) bool {
+	// must already have a write lock
+
+	var evicted bool
+	for c.overCapacity() {
+		ent := c.victim(keep)
+		if ent == nil {
+			break
+		}
+
+		// there are no timers to expire entries without them
+		if c.lazy && ent.dead(c.clock()) {
+			c.expireEntry(ent)
+			continue
+		}
+
+		c.spillEntry(ent)
+		c.evictEntry(ent)
+		c.bucket().evictions++
+		evicted = true
+	}
+
+	return evicted
+}
+
+func (c *cache) overCapacity() bool {
+	return len(c.items) > c.cap || (c.maxCost > 0 && c.cost > c.maxCost)
+}
+
+// residencyMargin is how many times its capacity, or maximum cost, the cache
+// may grow to while its entries are within their minimum residency
+const residencyMargin = 2
+
+// honorResidency reports whether the cache is within the bound that minimum
+// residencies may grow it to
+func (c *cache) honorResidency() bool {
+	return len(c.items) <= residencyMargin*c.cap &&
+		(c.maxCost <= 0 || c.cost <= residencyMargin*c.maxCost)
+}
+
+func (c *cache) resetHeaps(size int) {
+	h := make(ttlHeap, 0, size)
+	c.heap = &h
+
+	s := make(ttlHeap, 0)
+	c.scan = &s
+
+	if size > c.protectSize {
+		size = c.protectSize
+	}
+
+	p := make(ttlHeap, 0, size)
+	c.protected = &p
+}
+
+// heaps returns the heaps of all the segments, in the order they are evicted
+// from
+func (c *cache) heaps() []*ttlHeap {
+	return []*ttlHeap{c.scan, c.heap, c.protected}
+}
+
+// victim returns the soonest expiring entry other than keep that may be
+// evicted, preferring the scan segment, then the probationary segment, over
+// the protected one
+func (c *cache) victim(keep *entry) *entry {
+	now, resident := time.Now(), c.honorResidency()
+
+	if ent := victimIn(*c.scan, keep, now, resident); ent != nil {
+		return ent
+	}
+
+	if ent := victimIn(*c.heap, keep, now, resident); ent != nil {
+		return ent
+	}
+
+	return victimIn(*c.protected, keep, now, resident)
+}
+
+func victimIn(h ttlHeap, keep *entry, now time.Time, resident bool) *entry {
+	if len(h) == 0 {
+		return nil
+	}
+
+	if h[0].evictable(keep, now, resident) {
+		return h[0]
+	}
+
+	// fall back to searching the whole heap, which only happens when the
+	// soonest expiring entry is the one being set, is leased or has not yet
+	// been resident for its minimum
+	var ent *entry
+	for i, e := range h {
+		if e.evictable(keep, now, resident) && (ent == nil || h.Less(i, ent.index)) {
+			ent = e
+		}
+	}
+
+	return ent
+}
+
+func (c *cache) insertEntry(key, value interface{}, ttl time.Duration, opts []SetOption) *entry {
+	// must already have a write lock
+
+	ent := &entry{
+		key:   key,
+		value: value,
+		ttl:   ttl,
+		cost:  c.entryCost(key, value),
+	}
+
+	ent.apply(opts)
+	c.sum(ent)
+
+	c.seq++
+	ent.seq = c.seq
+
+	c.addCost(ent)
+
+	ent.created = time.Now()
+	ent.updated = ent.created
+	ent.accessed = ent.created
+	ent.expires = c.expiry(ent)
+	c.armEntry(ent)
+
+	ent.heap = c.heap
+	if ent.low {
+		ent.heap = c.scan
+	}
+	heap.Push(ent.heap, ent)
+	c.items[key] = ent
+	c.appendOrder(ent)
+
+	// any spilled value for the key is superseded
+	c.queueSpill(spillOp{kind: OpDel, key: key})
+
+	return ent
+}
+
+func (c *cache) updateEntry(e *entry, value interface{}, ttl time.Duration, opts []SetOption) {
+	// must already have a write lock
+
+	if !sameValue(e.value, value) {
+		c.dropValue(e)
+	}
+
+	// update with the new value, which has no timestamp unless set by
+	// SetIfNewer
+	e.value = value
+	e.version++
+	e.updated = time.Now()
+	c.sum(e)
+	e.stamp = time.Time{}
+
+	// drop the options of the previous value
+	e.onExpire = nil
+	e.visible = time.Time{}
+	e.uses = 0
+	e.low = false
+	e.resident = 0
+	e.meta = nil
+
+	// the ttl and cost may depend on the value, and the ttl on the options
+	e.ttl = ttl
+	e.apply(opts)
+	c.subCost(e)
+	e.cost = c.entryCost(e.key, value)
+	c.addCost(e)
+
+	// reset the ttl
+	c.resetEntryTTL(e)
+}
+
+// entryTTL returns the ttl of an entry set to the plain value
+func (c *cache) entryTTL(key, value interface{}) time.Duration {
+	ttl := c.ttl
+	if c.ttlFunc != nil {
+		ttl = c.ttlFunc(key, value)
+	}
+
+	return c.boundTTL(ttl)
+}
+
+// storedTTL is entryTTL for a value that is already encoded. A value that can
+// not be decoded gets the default ttl.
+func (c *cache) storedTTL(key, value interface{}) time.Duration {
+	if c.ttlFunc == nil || c.decode == nil {
+		return c.entryTTL(key, value)
+	}
+
+	plain, ok := c.plain(value)
+	if !ok {
+		return c.boundTTL(c.ttl)
+	}
+
+	return c.entryTTL(key, plain)
+}
+
+// boundTTL clamps ttl to the bounds set by WithTTLBounds, treating a
+// non-positive ttl as never expiring
+func (c *cache) boundTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl <= 0:
+		return c.maxTTL
+	case ttl < c.minTTL:
+		return c.minTTL
+	case c.maxTTL > 0 && ttl > c.maxTTL:
+		return c.maxTTL
+	}
+
+	return ttl
+}
+
+func (c *cache) entryCost(key, value interface{}) int64 {
+	if c.costFunc == nil {
+		return 1
+	}
+
+	return c.costFunc(key, value)
+}
+
+// expiry returns when the ttl of e elapses if it starts now, or once it
+// becomes visible
+func (c *cache) expiry(e *entry) time.Time {
+	start := c.clock()
+	if e.visible.After(start) {
+		start = e.visible
+	}
+
+	return start.Add(e.ttl)
+}
+
+func (c *cache) resetEntryTTL(e *entry) {
+	// must already have a write lock
+
+	// set the new expiration time
+	e.expires = c.expiry(e)
+
+	// reset the expiration timer
+	c.armEntry(e)
+
+	// fix heap ordering
+	heap.Fix(e.heap, e.index)
+}
+
+func (c *cache) touchEntry(e *entry) {
+	// must already have a write lock
+
+	e.hits++
+
+	// a scanned entry that is read again joins the working set
+	if e.heap == c.scan {
+		heap.Remove(e.heap, e.index)
+		e.heap = c.heap
+		heap.Push(e.heap, e)
+		return
+	}
+
+	if c.protectSize == 0 || e.heap == c.protected || e.hits <= c.protectHits {
+		return
+	}
+
+	// make room in the protected segment by demoting its soonest expiring
+	// entry
+	if c.protected.Len() >= c.protectSize {
+		demoted := heap.Pop(c.protected).(*entry)
+		demoted.hits = 0
+		demoted.heap = c.heap
+		heap.Push(demoted.heap, demoted)
+	}
+
+	heap.Remove(e.heap, e.index)
+	e.heap = c.protected
+	heap.Push(e.heap, e)
+}
+
+func (c *cache) armEntry(e *entry) {
+	// must already have a write lock
+
+	if e.ttl <= 0 {
+		c.disarm(e)
+		e.timer = nil
+		return
+	}
+
+	if c.lazy {
+		return
+	}
+
+	if c.paused() {
+		// the timer is armed again on Resume
+		c.disarm(e)
+		return
+	}
+
+	d := e.expires.Sub(time.Now())
+	if c.expirySpread > 0 {
+		d += time.Duration(rand.Int63n(int64(c.expirySpread)))
+	}
+
+	if c.granularity > 0 {
+		c.armTick(e, d)
+		return
+	}
+
+	if e.timer != nil {
+		e.timer.Reset(d)
+		return
+	}
+
+	e.timer = time.AfterFunc(d, func() {
+		c.do("expire", func() {
+			c.lock.Lock()
+			defer c.unlock()
+
+			// the entry may have been removed or replaced, or its ttl reset,
+			// while waiting for the lock. leased entries expire once released.
+			if c.items[e.key] != e || c.clock().Before(e.expires) || e.leased() {
+				return
+			}
+
+			c.expireEntry(e)
+		})
+	})
 }
 
-type Option func(*cache)
+// disarm stops the expiration timer of e, if any
+func (c *cache) disarm(e *entry) {
+	// must already have a write lock
 
-func WithTTL(val time.Duration) Option {
-	return func(c *cache) {
-		c.ttl = val
+	if e.timer != nil {
+		e.timer.Stop()
 	}
+
+	c.disarmTick(e)
 }
 
-func WithoutReset() Option {
-	return func(c *cache) {
-		c.NoReset = true
-	}
+// unlock releases the write lock and then delivers any entries evicted while
+// it was held. It also shrinks the cache if WithAutoShrink is set and enough
+// entries were removed.
+func (c *cache) unlock() {
+	w := c.unlockDeferring()
+	w.run()
 }
 
-// cache is the type that implements the ttlru
-type cache struct {
-	cap     int
-	ttl     time.Duration
-	items   map[interface{}]*entry
-	heap    *ttlHeap
-	lock    sync.RWMutex
-	NoReset bool
+// afterUnlock is the work left once the write lock is released: flushing the
+// spill and delivering entries to the callbacks
+type afterUnlock struct {
+	c         *cache
+	evicted   []Entry
+	expired   []*entry
+	destroyed []Entry
+	spillOps  []spillOp
+
+	// the callbacks are read under the lock, as Configure may change them
+	onEvictBatch func(entries []Entry)
+	destructor   func(key, value interface{})
 }
 
-// New creates a new Cache with cap entries that expire after ttl has
-// elapsed since the item was added, modified or accessed.
-func New(cap int, opts ...Option) Cache {
-	c := cache{cap: cap}
+// unlockDeferring releases the write lock like unlock, but returns the work
+// that follows for the caller to run once it holds no other lock
+func (c *cache) unlockDeferring() afterUnlock {
+	c.maybeShrink()
 
-	for _, opt := range opts {
-		opt(&c)
+	evicted, expired, destroyed := c.evicted, c.expiredCallbacks, c.destroyed
+	c.evicted, c.expiredCallbacks, c.destroyed = nil, nil, nil
+
+	spillOps := c.spillOps
+	c.spillOps = nil
+
+	// changes to the spill are made in the order they were queued, and
+	// before any spill reads that follow
+	if len(spillOps) > 0 {
+		c.spillLock.Lock()
 	}
 
-	if c.cap <= 0 || c.ttl < 0 {
-		return nil
+	w := afterUnlock{
+		c:            c,
+		evicted:      evicted,
+		expired:      expired,
+		destroyed:    destroyed,
+		spillOps:     spillOps,
+		onEvictBatch: c.onEvictBatch,
+		destructor:   c.destructor,
 	}
 
-	c.items = make(map[interface{}]*entry, cap)
+	c.lock.Unlock()
 
-	h := make(ttlHeap, 0, cap)
-	c.heap = &h
+	return w
+}
 
-	// no need to init the heap as there are no items yet
+func (w afterUnlock) run() {
+	c := w.c
 
-	return &c
-}
+	if len(w.spillOps) > 0 {
+		c.flushSpill(w.spillOps)
+	}
 
-func (c *cache) Set(key, value interface{}) bool {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	if len(w.evicted) > 0 && w.onEvictBatch != nil {
+		w.onEvictBatch(w.evicted)
+	}
 
-	// Check for existing item
-	if ent, ok := c.items[key]; ok {
-		c.updateEntry(ent, value)
-		return false
+	for _, e := range w.expired {
+		e.onExpire(e.key, c.decoded(e.value))
 	}
 
-	// Evict oldest if next entry would exceed capacity
-	evict := len(*c.heap) == c.cap
-	if evict {
-		if ent := (*c.heap)[0]; ent != nil {
-			c.removeEntry(ent)
+	if w.destructor != nil {
+		for _, e := range w.destroyed {
+			w.destructor(e.Key, c.decoded(e.Value))
 		}
 	}
+}
 
-	c.insertEntry(key, value)
+func (c *cache) removeEntry(e *entry) {
+	// must already have a write lock
 
-	return evict
+	c.unlinkEntry(e)
+	c.dropValue(e)
 }
 
-func (c *cache) insertEntry(key, value interface{}) *entry {
+// unlinkEntry removes e from the cache without releasing its value
+func (c *cache) unlinkEntry(e *entry) {
 	// must already have a write lock
 
-	ent := &entry{
-		key:     key,
-		value:   value,
-		expires: time.Now().Add(c.ttl),
+	if e.index >= 0 {
+		heap.Remove(e.heap, e.index)
 	}
 
-	if c.ttl > 0 {
-		ent.timer = time.AfterFunc(c.ttl, func() {
-			c.lock.Lock()
-			defer c.lock.Unlock()
-			c.removeEntry(ent)
-		})
+	// if a ttl was set, stop the timer to avoid leaking timers
+	c.disarm(e)
+
+	// delete the item from the map
+	delete(c.items, e.key)
+	c.subCost(e)
+}
+
+func (c *cache) expireEntry(e *entry) {
+	// must already have a write lock
+
+	c.evictEntry(e)
+
+	if e.onExpire != nil {
+		c.expiredCallbacks = append(c.expiredCallbacks, e)
 	}
 
-	heap.Push(c.heap, ent)
-	c.items[key] = ent
+	if c.expired == nil {
+		return
+	}
 
-	return ent
+	select {
+	case c.expired <- c.export(e):
+	default:
+		c.expiredOverflow++
+	}
 }
 
-func (c *cache) updateEntry(e *entry, value interface{}) {
+func (c *cache) evictEntry(e *entry) {
 	// must already have a write lock
 
-	// update with the new value
-	e.value = value
+	c.removeEntry(e)
 
-	// reset the ttl
-	c.resetEntryTTL(e)
+	if c.onEvictBatch != nil {
+		c.evicted = append(c.evicted, c.export(e))
+	}
 }
 
-func (c *cache) resetEntryTTL(e *entry) {
-	// must already have a write lock
+func (c *cache) Get(key interface{}) (interface{}, bool) {
+	start := c.sample()
+	value, ok := c.get(key, true, false)
+	c.trace(key, hitOrMiss(ok), start)
+	return value, ok
+}
 
-	// reset the expiration timer
-	if c.ttl > 0 {
-		e.timer.Reset(c.ttl)
+func (c *cache) GetNoReset(key interface{}) (interface{}, bool) {
+	start := c.sample()
+	value, ok := c.get(key, false, false)
+	c.trace(key, hitOrMiss(ok), start)
+	return value, ok
+}
+
+func (c *cache) Peek(key interface{}) (interface{}, bool) {
+	c.lock.RLock()
+	ent, ok := c.items[key]
+	if ok && ent.live(c.clock()) && !c.corrupt(ent) {
+		value, ok := c.plain(ent.value)
+		c.lock.RUnlock()
+		return value, ok
 	}
+	c.lock.RUnlock()
 
-	// set the new expiration time
-	e.expires = time.Now().Add(c.ttl)
+	if c.parent != nil {
+		return c.parent.Peek(key)
+	}
 
-	// fix heap ordering
-	heap.Fix(c.heap, e.index)
+	return nil, false
 }
 
-func (c *cache) removeEntry(e *entry) {
-	// must already have a write lock
+func (c *cache) Contains(key interface{}) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-	if e.index >= 0 {
-		heap.Remove(c.heap, e.index)
+	ent, ok := c.items[key]
+	return ok && ent.live(c.clock())
+}
+
+func (c *cache) GetWithExpiration(key interface{}) (interface{}, time.Time, bool) {
+	return c.getWithExpiration(key, false)
+}
+
+func (c *cache) getWithExpiration(key interface{}, view bool) (interface{}, time.Time, bool) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent := c.access(key, !c.NoReset, view)
+	if ent == nil {
+		return nil, time.Time{}, false
 	}
 
-	// if a ttl was set, stop the timer to avoid leaking timers
-	if e.timer != nil {
-		e.timer.Stop()
+	value, ok := c.plain(ent.value)
+	if !ok {
+		return nil, time.Time{}, false
 	}
 
-	// delete the item from the map
-	delete(c.items, e.key)
+	var expires time.Time
+	if ent.ttl > 0 {
+		expires = ent.expires
+	}
+
+	return value, expires, true
 }
 
-func (c *cache) Get(key interface{}) (interface{}, bool) {
+func (c *cache) GetFresh(key interface{}, maxAge time.Duration) (interface{}, bool) {
+	return c.getFresh(key, maxAge, false)
+}
+
+func (c *cache) getFresh(key interface{}, maxAge time.Duration, view bool) (interface{}, bool) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
+
+	if ent, ok := c.items[key]; !ok || time.Since(ent.updated) > maxAge {
+		return nil, false
+	}
+
+	if ent := c.access(key, !c.NoReset, view); ent != nil {
+		return c.plain(ent.value)
+	}
+
+	return nil, false
+}
+
+// access returns the live entry for key, if any, recording the access to it
+// and resetting its ttl if reset is set. Reads through a read only view, for
+// which view is set, miss entries with a limited number of uses rather than
+// use them up.
+func (c *cache) access(key interface{}, reset, view bool) *entry {
+	// must already have a write lock
 
 	if ent, ok := c.items[key]; ok {
+		if view && ent.uses > 0 {
+			return nil
+		}
+
+		if c.corrupt(ent) {
+			c.removeEntry(ent)
+			return nil
+		}
+
 		// the item should be automatically removed when it expires, but we
 		// check just to be safe
-		if c.ttl == 0 || time.Now().Before(ent.expires) {
-			if !c.NoReset {
+		if ent.live(c.clock()) {
+			ent.accessed = time.Now()
+			if reset {
 				c.resetEntryTTL(ent)
 			}
-			return ent.value, true
+			c.touchEntry(ent)
+
+			if ent.uses > 0 {
+				ent.uses--
+				if ent.uses == 0 {
+					// used up, this is the last time it is returned. Replicas
+					// do not count the uses, so they are told to delete it.
+					c.removeEntry(ent)
+					c.emitUsedUp(key)
+				}
+			}
+
+			return ent
 		}
 	}
 
-	return nil, false
+	return nil
 }
 
 func (c *cache) Keys() []interface{} {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
+	return c.appendKeys(make([]interface{}, 0, len(c.items)))
+}
 
-	keys := make([]interface{}, 0, len(c.items))
-	for k, v := range c.items {
-		// the item should be automatically removed when it expires, but we
-		// check just to be safe
-		if c.ttl == 0 || time.Now().Before(v.expires) {
-			keys = append(keys, k)
+func (c *cache) AppendKeys(dst []interface{}) []interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.appendKeys(dst)
+}
+
+func (c *cache) appendKeys(dst []interface{}) []interface{} {
+	// must already have a read lock
+
+	now := c.clock()
+
+	if c.keyOrder == UnorderedKeys {
+		for k, v := range c.items {
+			// the item should be automatically removed when it expires, but we
+			// check just to be safe
+			if v.live(now) {
+				dst = append(dst, k)
+			}
+		}
+
+		return dst
+	}
+
+	for _, v := range c.orderedEntries(now) {
+		dst = append(dst, v.key)
+	}
+
+	return dst
+}
+
+func (c *cache) AppendValues(dst []interface{}) []interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := c.clock()
+
+	if c.keyOrder == UnorderedKeys {
+		for _, v := range c.items {
+			if v.live(now) {
+				dst = c.appendValue(dst, v.value)
+			}
+		}
+
+		return dst
+	}
+
+	for _, v := range c.orderedEntries(now) {
+		dst = c.appendValue(dst, v.value)
+	}
+
+	return dst
+}
+
+func (c *cache) Entries() []Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.appendEntries(make([]Entry, 0, len(c.items)))
+}
+
+func (c *cache) AppendEntries(dst []Entry) []Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.appendEntries(dst)
+}
+
+func (c *cache) appendEntries(dst []Entry) []Entry {
+	// must already have a read lock
+
+	now := c.clock()
+
+	if c.keyOrder == UnorderedKeys {
+		for _, v := range c.items {
+			if v.live(now) {
+				dst = append(dst, c.export(v))
+			}
+		}
+
+		return dst
+	}
+
+	for _, v := range c.orderedEntries(now) {
+		dst = append(dst, c.export(v))
+	}
+
+	return dst
+}
+
+// orderedEntries returns the live entries in the order set by WithKeyOrder
+func (c *cache) orderedEntries(now time.Time) []*entry {
+	// must already have a read lock
+
+	ents := make([]*entry, 0, len(c.items))
+	for _, v := range c.items {
+		if v.live(now) {
+			ents = append(ents, v)
 		}
 	}
 
-	return keys
+	switch c.keyOrder {
+	case InsertionOrder:
+		sort.Slice(ents, func(i, j int) bool {
+			return ents[i].seq < ents[j].seq
+		})
+	case ExpirationOrder:
+		sort.Slice(ents, func(i, j int) bool {
+			a, b := ents[i], ents[j]
+			if a.expiresBefore(b) || b.expiresBefore(a) {
+				return a.expiresBefore(b)
+			}
+			return a.seq < b.seq
+		})
+	}
+
+	return ents
 }
 
 func (c *cache) Len() int {
@@ -226,30 +1698,206 @@ func (c *cache) Len() int {
 }
 
 func (c *cache) Cap() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.cap
 }
 
 func (c *cache) Purge() {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
+
+	c.purge()
+
+	var stamp time.Time
+	if c.lww {
+		stamp = time.Now()
+		if !stamp.After(c.purgeStamp) {
+			stamp = c.purgeStamp.Add(1)
+		}
+		c.purgeStamp = stamp
+	}
+
+	c.emit(Op{Kind: OpPurge, Stamp: stamp})
+}
+
+func (c *cache) purge() {
+	// must already have a write lock
 
 	for _, e := range c.items {
 		e.index = -1
+		c.disarm(e)
+
+		if c.onEvictBatch != nil {
+			c.evicted = append(c.evicted, c.export(e))
+		}
+
+		c.dropValue(e)
 	}
 
-	h := make(ttlHeap, 0, c.cap)
-	c.heap = &h
-	c.items = make(map[interface{}]*entry, c.cap)
+	size := c.cap
+	if c.autoShrink {
+		size = 0
+	}
+
+	c.resetHeaps(size)
+	c.items = make(map[interface{}]*entry, size)
+	c.order = nil
+	c.cost = 0
+	c.costs = [costBuckets]uint64{}
+	c.peak = 0
+
+	c.queueSpill(spillOp{kind: OpPurge})
 }
 
 func (c *cache) Del(key interface{}) bool {
+	defer c.trace(key, TraceDel, c.sample())
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	return c.del(key) != nil
+}
+
+func (c *cache) DelGet(key interface{}) (interface{}, bool) {
+	defer c.trace(key, TraceDel, c.sample())
+
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
+
+	if ent := c.del(key); ent != nil {
+		return c.decoded(ent.value), true
+	}
+
+	return nil, false
+}
+
+// del does the work of Del, returning the deleted entry, if any
+func (c *cache) del(key interface{}) *entry {
+	// must already have a write lock
+
+	ent := c.detach(key)
+	if ent != nil {
+		c.dropValue(ent)
+	}
+
+	return ent
+}
+
+// emitUsedUp records in the oplog that the entry for key was removed as it
+// was used up
+func (c *cache) emitUsedUp(key interface{}) {
+	// must already have a write lock
+
+	var stamp time.Time
+	if c.lww {
+		stamp = c.nextStamp(key)
+		c.bury(key, stamp)
+	}
+
+	c.emit(Op{Kind: OpDel, Key: key, Stamp: stamp})
+}
+
+// detach removes the entry for key, if any, as Del does, but without
+// releasing its value
+func (c *cache) detach(key interface{}) *entry {
+	// must already have a write lock
+
+	c.queueSpill(spillOp{kind: OpDel, key: key})
 
 	if ent, ok := c.items[key]; ok {
-		c.removeEntry(ent)
-		return true
+		var stamp time.Time
+		switch {
+		case c.lww:
+			stamp = c.nextStamp(key)
+			c.bury(key, stamp)
+		case c.tombstoneWindow > 0:
+			c.bury(key, time.Now())
+		}
+
+		c.cool(key)
+		c.unlinkEntry(ent)
+		c.emit(Op{Kind: OpDel, Key: key, Stamp: stamp})
+		return ent
+	}
+
+	return nil
+}
+
+func (c *cache) Expired() <-chan Entry {
+	return c.expired
+}
+
+func (c *cache) ExpiredOverflow() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.expiredOverflow
+}
+
+func (c *cache) Age(key interface{}) (time.Duration, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if ent, ok := c.items[key]; ok && ent.live(c.clock()) {
+		return time.Since(ent.created), true
+	}
+
+	return 0, false
+}
+
+func (c *cache) GetEntry(key interface{}) (Entry, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if ent, ok := c.items[key]; ok && ent.live(c.clock()) {
+		value, err := c.decodeValue(ent.value)
+		if err != nil {
+			return Entry{}, false
+		}
+
+		e := ent.export()
+		e.Value = value
+		return e, true
+	}
+
+	return Entry{}, false
+}
+
+func (c *cache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *cache) Pause() {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.paused() {
+		return
+	}
+
+	c.pausedAt = c.now()
+
+	for _, e := range c.items {
+		c.disarm(e)
 	}
+}
+
+func (c *cache) Resume() {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if !c.paused() {
+		return
+	}
+
+	d := c.now().Sub(c.pausedAt)
+	c.pausedAt = time.Time{}
 
-	return false
+	// every expiration moves by the same amount, so the heaps stay ordered
+	for _, e := range c.items {
+		e.expires = e.expires.Add(d)
+		c.armEntry(e)
+	}
 }
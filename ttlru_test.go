@@ -1,15 +1,33 @@
 package ttlru
 
 import (
+	"bytes"
 	"container/heap"
 	"context"
+	"errors"
+	"math"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// requireTimers skips a test that relies on timers, or the background work
+// that needs them, which are not used when built with the ttlru_notimers tag
+func requireTimers(t *testing.T) {
+	t.Helper()
+	if !TimersSupported {
+		t.Skip("timers are not supported in this build")
+	}
+}
+
 func TestGeneral(t *testing.T) {
+	requireTimers(t)
+
 	l := New(128, WithTTL(2*time.Second))
 
 	require.NotNil(t, l)
@@ -103,6 +121,30 @@ func TestInvalidCreation(t *testing.T) {
 	require.Nil(t, New(1, WithTTL(-1)))
 }
 
+func TestNewWithError(t *testing.T) {
+	l, err := NewWithError(1, WithTTL(time.Second))
+	require.NoError(t, err)
+	require.NotNil(t, l)
+
+	for _, test := range []struct {
+		cap  int
+		opts []Option
+		err  string
+	}{
+		{0, nil, "ttlru: capacity 0 is not positive"},
+		{1, []Option{WithTTL(-1)}, "ttlru: negative ttl -1ns"},
+		{1, []Option{WithMaxCost(0)}, "ttlru: max cost 0 is not positive"},
+		{1, []Option{WithCostFunc(func(key, value interface{}) int64 { return 1 })}, "ttlru: WithCostFunc requires WithMaxCost"},
+		{2, []Option{WithProtectedSegment(1, 2)}, "ttlru: protected segment size 2 is not smaller than the capacity 2"},
+		{1, []Option{WithExpiredChannel(-1)}, "ttlru: negative expired channel size -1"},
+		{1, []Option{WithOplog(-1)}, "ttlru: negative oplog size -1"},
+	} {
+		l, err := NewWithError(test.cap, test.opts...)
+		require.Nil(t, l)
+		require.EqualError(t, err, test.err)
+	}
+}
+
 func TestSetShouldAlsoUpdate(t *testing.T) {
 	l := New(1, WithTTL(2*time.Second))
 	require.NotNil(t, l)
@@ -246,3 +288,2441 @@ func TestFullCacheTTLEviction(t *testing.T) {
 	_, ok = l.Get(0)
 	require.True(t, ok)
 }
+
+func TestTTLFunc(t *testing.T) {
+	requireTimers(t)
+
+	l := New(2, WithTTL(time.Hour), WithTTLFunc(func(key, value interface{}) time.Duration {
+		return value.(time.Duration)
+	}))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set("short", 50*time.Millisecond))
+	require.False(t, l.Set("forever", time.Duration(0)))
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok := l.Get("short")
+	require.False(t, ok)
+
+	v, ok := l.Get("forever")
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), v)
+
+	// updating the value recomputes the ttl
+	require.False(t, l.Set("forever", 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok = l.Get("forever")
+	require.False(t, ok)
+	require.Equal(t, 0, l.Len())
+}
+
+func TestMaxCost(t *testing.T) {
+	l := New(10, WithTTL(time.Hour), WithMaxCost(10), WithCostFunc(func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "aaaa"))
+	require.False(t, l.Set(2, "bbbb"))
+	require.Equal(t, 2, l.Len())
+
+	// 1 is the soonest expiring, and must make room for 3
+	require.True(t, l.Set(3, "cccc"))
+	require.Equal(t, 2, l.Len())
+	_, ok := l.Get(1)
+	require.False(t, ok)
+
+	// growing 3 must evict 2, but never 3 itself
+	require.True(t, l.Set(3, "cccccccc"))
+	require.Equal(t, 1, l.Len())
+	v, ok := l.Get(3)
+	require.True(t, ok)
+	require.Equal(t, "cccccccc", v)
+
+	require.Nil(t, New(1, WithMaxCost(-1)))
+}
+
+func TestProtectedSegment(t *testing.T) {
+	l := New(2, WithTTL(time.Hour), WithoutReset(), WithProtectedSegment(1, 1))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, 1))
+	require.False(t, l.Set(2, 2))
+
+	// promote 1, which remains the soonest expiring entry
+	for i := 0; i < 2; i++ {
+		_, ok := l.Get(1)
+		require.True(t, ok)
+	}
+
+	require.True(t, l.Set(3, 3))
+	_, ok := l.Get(2)
+	require.False(t, ok)
+
+	require.True(t, l.Set(4, 4))
+	_, ok = l.Get(3)
+	require.False(t, ok)
+
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	require.Nil(t, New(1, WithProtectedSegment(-1, 1)))
+	require.Nil(t, New(1, WithProtectedSegment(1, -1)))
+}
+
+func entryKeys(entries []Entry) []interface{} {
+	keys := make([]interface{}, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+func TestOnEvictBatch(t *testing.T) {
+	requireTimers(t)
+
+	batches := make(chan []Entry, 3)
+	l := New(2, WithTTL(50*time.Millisecond), WithOnEvictBatch(func(entries []Entry) {
+		batches <- entries
+	}))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, 1))
+	require.False(t, l.Set(2, 2))
+	require.True(t, l.Set(3, 3))
+	require.Equal(t, []interface{}{1}, entryKeys(<-batches))
+
+	// expirations fire independently
+	expired := append(<-batches, <-batches...)
+	require.ElementsMatch(t, []interface{}{2, 3}, entryKeys(expired))
+
+	require.False(t, l.Set(4, 4))
+	require.False(t, l.Set(5, 5))
+	l.Purge()
+	require.ElementsMatch(t, []interface{}{4, 5}, entryKeys(<-batches))
+
+	// explicit deletes are not evictions
+	require.False(t, l.Set(6, 6))
+	require.True(t, l.Del(6))
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, batches, 0)
+}
+
+func TestExpiredChannel(t *testing.T) {
+	requireTimers(t)
+
+	require.Nil(t, New(1).Expired())
+
+	l := New(3, WithTTL(50*time.Millisecond), WithExpiredChannel(1))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, 1))
+	require.False(t, l.Set(2, 2))
+	require.False(t, l.Set(3, 3))
+	require.True(t, l.Del(3))
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, uint64(1), l.ExpiredOverflow())
+
+	ent := <-l.Expired()
+	require.Contains(t, []interface{}{1, 2}, ent.Key)
+	require.Equal(t, ent.Key, ent.Value)
+	require.Len(t, l.Expired(), 0)
+}
+
+func TestKeyOrder(t *testing.T) {
+	l := New(3, WithKeyOrder(InsertionOrder), WithTTLFunc(func(key, value interface{}) time.Duration {
+		return value.(time.Duration)
+	}))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set("a", 3*time.Hour))
+	require.False(t, l.Set("b", time.Hour))
+	require.False(t, l.Set("c", 2*time.Hour))
+
+	// updates do not change the insertion order
+	require.False(t, l.Set("a", 3*time.Hour))
+	require.Equal(t, []interface{}{"a", "b", "c"}, l.Keys())
+
+	l = New(4, WithKeyOrder(ExpirationOrder), WithTTLFunc(func(key, value interface{}) time.Duration {
+		return value.(time.Duration)
+	}))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set("forever", time.Duration(0)))
+	require.False(t, l.Set("a", 3*time.Hour))
+	require.False(t, l.Set("b", time.Hour))
+	require.False(t, l.Set("c", 2*time.Hour))
+	require.Equal(t, []interface{}{"b", "c", "a", "forever"}, l.Keys())
+
+	require.Nil(t, New(1, WithKeyOrder(KeyOrder(-1))))
+}
+
+func TestAge(t *testing.T) {
+	l := New(1, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	_, ok := l.Age(1)
+	require.False(t, ok)
+
+	require.False(t, l.Set(1, 1))
+	time.Sleep(50 * time.Millisecond)
+
+	// neither updates nor accesses reset the age
+	require.False(t, l.Set(1, 2))
+	_, ok = l.Get(1)
+	require.True(t, ok)
+
+	age, ok := l.Age(1)
+	require.True(t, ok)
+	require.True(t, age >= 50*time.Millisecond)
+}
+
+func TestEntries(t *testing.T) {
+	l := New(2, WithTTL(time.Hour), WithKeyOrder(InsertionOrder))
+	require.NotNil(t, l)
+
+	_, ok := l.GetEntry(1)
+	require.False(t, ok)
+
+	require.False(t, l.Set(1, 1))
+	require.False(t, l.Set(2, 2))
+
+	ent, ok := l.GetEntry(1)
+	require.True(t, ok)
+	require.Equal(t, 1, ent.Value)
+	require.Equal(t, ent.CreatedAt, ent.LastAccessedAt)
+
+	time.Sleep(10 * time.Millisecond)
+	_, ok = l.Get(1)
+	require.True(t, ok)
+
+	entries := l.Entries()
+	require.Equal(t, []interface{}{1, 2}, entryKeys(entries))
+	require.True(t, entries[0].LastAccessedAt.After(entries[0].CreatedAt))
+	require.Equal(t, entries[1].CreatedAt, entries[1].LastAccessedAt)
+}
+
+func TestSetIfNewer(t *testing.T) {
+	l := New(1, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	now := time.Now()
+
+	require.True(t, l.SetIfNewer(1, "b", now))
+	require.False(t, l.SetIfNewer(1, "a", now.Add(-time.Second)))
+	require.False(t, l.SetIfNewer(1, "a", now))
+
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "b", v)
+
+	require.True(t, l.SetIfNewer(1, "c", now.Add(time.Second)))
+	v, _ = l.Get(1)
+	require.Equal(t, "c", v)
+
+	// a plain Set drops the timestamp
+	require.False(t, l.Set(1, "d"))
+	require.True(t, l.SetIfNewer(1, "e", now))
+	v, _ = l.Get(1)
+	require.Equal(t, "e", v)
+}
+
+func TestOplog(t *testing.T) {
+	require.Nil(t, New(1).Oplog())
+
+	l := New(1, WithTTL(time.Hour), WithOplog(4))
+	require.NotNil(t, l)
+
+	now := time.Now()
+	require.False(t, l.Set(1, 1))
+	require.True(t, l.SetIfNewer(1, 2, now))
+	require.False(t, l.SetIfNewer(1, 3, now))
+	require.True(t, l.Del(1))
+	require.False(t, l.Del(1))
+	l.Purge()
+	l.Purge()
+
+	require.Equal(t, Op{Kind: OpSet, Key: 1, Value: 1}, <-l.Oplog())
+	require.Equal(t, Op{Kind: OpSet, Key: 1, Value: 2, Stamp: now}, <-l.Oplog())
+	require.Equal(t, Op{Kind: OpDel, Key: 1}, <-l.Oplog())
+	require.Equal(t, Op{Kind: OpPurge}, <-l.Oplog())
+	require.Equal(t, uint64(1), l.OplogOverflow())
+
+	// the ttl and visibility of an entry are replicated
+	at := now.Add(time.Minute)
+	l.SetWithTTL(1, 1, time.Minute)
+	l.SetAt(2, 2, at)
+	ttlOp, atOp := <-l.Oplog(), <-l.Oplog()
+	require.Equal(t, Op{Kind: OpSet, Key: 1, Value: 1, TTL: time.Minute}, ttlOp)
+	require.Equal(t, Op{Kind: OpSet, Key: 2, Value: 2, VisibleAt: at}, atOp)
+
+	r := New(2, WithTTL(time.Hour))
+	require.True(t, r.Apply(ttlOp))
+	require.True(t, r.Apply(atOp))
+	require.Equal(t, time.Minute, r.(*cache).items[1].ttl)
+	require.False(t, r.Contains(2))
+	require.Equal(t, at, r.(*cache).items[2].visible)
+
+	// as is a ttl that never expires
+	l.SetWithTTL(1, 1, 0)
+	ttlOp = <-l.Oplog()
+	require.Equal(t, Op{Kind: OpSet, Key: 1, Value: 1, TTL: -1}, ttlOp)
+	require.True(t, r.Apply(ttlOp))
+	require.Zero(t, r.(*cache).items[1].ttl)
+}
+
+func TestMemoize(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	fn := Memoize(New(2, WithTTL(time.Hour)), func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if key == "fail" {
+			return nil, errors.New("failed")
+		}
+		return key.(int) * 2, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := fn(21)
+			require.NoError(t, err)
+			require.Equal(t, 42, v)
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	v, err := fn(21)
+	require.NoError(t, err)
+	require.Equal(t, 42, v)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// errors are not cached
+	_, err = fn("fail")
+	require.Error(t, err)
+	_, err = fn("fail")
+	require.Error(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestMemoizeContextWait(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	fn := MemoizeContext(New(2, WithTTL(time.Hour)), func(_ context.Context, key interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return key, nil
+	})
+
+	loaded := make(chan interface{})
+	go func() {
+		v, err := fn(context.Background(), 1)
+		require.NoError(t, err)
+		loaded <- v
+	}()
+	<-started
+
+	// a waiter gives up when its own context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := fn(ctx, 1)
+	require.Equal(t, ErrLoadTimeout, err)
+
+	// while the load carries on for the caller that started it
+	close(release)
+	require.Equal(t, 1, <-loaded)
+}
+
+func TestMemoizeContextCancel(t *testing.T) {
+	type ctxKey struct{}
+	started, release := make(chan struct{}), make(chan struct{})
+
+	fn := MemoizeContext(New(2, WithTTL(time.Hour)), func(ctx context.Context, key interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return ctx.Value(ctxKey{}), ctx.Err()
+	})
+
+	// the caller that starts the load gives up when its context is done
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	gaveUp := make(chan error)
+	go func() {
+		_, err := fn(ctx, 1)
+		gaveUp <- err
+	}()
+	<-started
+
+	loaded := make(chan interface{})
+	go func() {
+		v, err := fn(context.Background(), 1)
+		require.NoError(t, err)
+		loaded <- v
+	}()
+
+	cancel()
+	require.Equal(t, ErrLoadTimeout, <-gaveUp)
+
+	// without cancelling the load, which keeps the values of its context
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	require.Equal(t, "value", <-loaded)
+}
+
+// staleGet misses every Get, as if each were made before the key was loaded
+type staleGet struct {
+	Cache
+}
+
+func (staleGet) Get(interface{}) (interface{}, bool) {
+	return nil, false
+}
+
+func TestMemoizeRecheck(t *testing.T) {
+	var calls int32
+
+	fn := Memoize(staleGet{New(2, WithTTL(time.Hour))}, func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return key, nil
+	})
+
+	// a miss made before an invocation set the key does not invoke fn again
+	for i := 0; i < 3; i++ {
+		v, err := fn(1)
+		require.NoError(t, err)
+		require.Equal(t, 1, v)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestMemoizePanic(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	fn := Memoize(New(2, WithTTL(time.Hour)), func(key interface{}) (interface{}, error) {
+		if key == "panic" {
+			close(started)
+			<-release
+			panic("load")
+		}
+		return key, nil
+	})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		_, _ = fn("panic")
+	}()
+	<-started
+
+	waited := make(chan error)
+	go func() {
+		_, err := fn("panic")
+		waited <- err
+	}()
+
+	// the waiter is sharing the invocation before it panics
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	require.Equal(t, "load", <-panicked)
+	require.Equal(t, ErrLoadPanic, <-waited)
+
+	// the key is not left loading
+	v, err := fn(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+}
+
+func TestExpireCallback(t *testing.T) {
+	requireTimers(t)
+
+	l := New(3, WithTTL(50*time.Millisecond))
+	require.NotNil(t, l)
+
+	expired := make(chan interface{}, 3)
+	cb := WithExpireCallback(func(key, value interface{}) {
+		// the cache is not locked while running the callback
+		l.Len()
+		expired <- key
+	})
+
+	require.False(t, l.Set(1, 1, cb))
+	require.False(t, l.Set(2, 2, cb))
+	require.False(t, l.Set(3, 3, cb))
+
+	// neither deleted nor replaced entries call the callback
+	require.True(t, l.Del(2))
+	require.False(t, l.Set(3, 3))
+
+	require.Equal(t, 1, <-expired)
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, expired, 0)
+}
+
+func TestMemoryLimitShedding(t *testing.T) {
+	requireTimers(t)
+
+	l := New(10, WithTTL(time.Hour), WithMemoryLimitShedding(0.9, 0.5, time.Hour))
+	require.NotNil(t, l)
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		require.False(t, l.Set(i, i))
+	}
+
+	c := l.(*cache)
+
+	// no limit, or below the threshold
+	c.shed(100, math.MaxInt64)
+	c.shed(89, 100)
+	require.Equal(t, 10, l.Len())
+
+	c.shed(90, 100)
+	require.Equal(t, 5, l.Len())
+
+	// the soonest expiring entries were shed
+	for i := 0; i < 5; i++ {
+		_, ok := l.Get(i)
+		require.False(t, ok)
+	}
+
+	require.Nil(t, New(1, WithMemoryLimitShedding(0, 0.5, time.Second)))
+	require.Nil(t, New(1, WithMemoryLimitShedding(0.9, 1.5, time.Second)))
+	require.Nil(t, New(1, WithMemoryLimitShedding(0.9, 0.5, -time.Second)))
+}
+
+func TestShrink(t *testing.T) {
+	l := New(4096, WithAutoShrink())
+	require.NotNil(t, l)
+
+	for i := 0; i < 2048; i++ {
+		require.False(t, l.Set(i, i))
+	}
+
+	c := l.(*cache)
+	require.Equal(t, 2048, c.peak)
+
+	// not yet below a quarter of the peak
+	for i := 0; i < 1536; i++ {
+		require.True(t, l.Del(i))
+	}
+	require.Equal(t, 2048, c.peak)
+
+	require.True(t, l.Del(1536))
+	require.Equal(t, 511, c.peak)
+	require.Equal(t, 511, cap(*c.heap))
+
+	// the heap is still intact
+	for i, e := range *c.heap {
+		require.Equal(t, i, e.index)
+		require.Equal(t, c.heap, e.heap)
+	}
+	for i := 1537; i < 2048; i++ {
+		v, ok := l.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+
+	l = New(1024)
+	require.NotNil(t, l)
+	require.False(t, l.Set(1, 1))
+	l.Shrink()
+	require.Equal(t, 1, cap(*l.(*cache).heap))
+
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+}
+
+func TestGetDoesNotAllocate(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	var key interface{} = "key"
+	require.False(t, l.Set(key, 1))
+
+	var miss interface{} = "miss"
+
+	for _, fn := range []func(){
+		func() { l.Get(key) },
+		func() { l.Get(miss) },
+	} {
+		require.Equal(t, float64(0), testing.AllocsPerRun(100, fn))
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	l := New(1024, WithTTL(time.Hour))
+
+	keys := make([]interface{}, 1024)
+	for i := range keys {
+		keys[i] = i
+		l.Set(keys[i], i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		l.Get(keys[i%len(keys)])
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	parts := make([]Partition, 4)
+	for i := range parts {
+		parts[i] = New(1000, WithTTL(time.Hour))
+	}
+
+	require.Nil(t, NewPartitioned(nil))
+	require.Nil(t, NewPartitioned(parts, WithReplicas(5)))
+
+	p := NewPartitioned(parts, WithReplicas(2))
+	require.NotNil(t, p)
+
+	for i := 0; i < 1000; i++ {
+		require.Len(t, p.Partitions(i), 2)
+		require.False(t, p.Set(i, i))
+	}
+
+	// every key is stored twice, spread over all the partitions
+	var total int
+	for _, part := range parts {
+		n := part.(Cache).Len()
+		require.True(t, n > 350, "partition holds %d keys", n)
+		total += n
+	}
+	require.Equal(t, 2000, total)
+
+	// a key survives the loss of one of its replicas
+	p.Partitions(42)[0].Del(42)
+	v, ok := p.Get(42)
+	require.True(t, ok)
+	require.Equal(t, 42, v)
+
+	require.True(t, p.Del(42))
+	_, ok = p.Get(42)
+	require.False(t, ok)
+}
+
+func TestKeysPage(t *testing.T) {
+	l := New(100, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	for i := 0; i < 10; i++ {
+		require.False(t, l.Set(i, i))
+	}
+	require.True(t, l.Del(3))
+
+	var keys []interface{}
+	var pages int
+	for cursor := ""; ; {
+		var page []interface{}
+		page, cursor = l.KeysPage(cursor, 4)
+		require.True(t, len(page) <= 4)
+		keys = append(keys, page...)
+		pages++
+
+		if cursor == "" {
+			break
+		}
+	}
+
+	require.Equal(t, 3, pages)
+	require.Equal(t, []interface{}{0, 1, 2, 4, 5, 6, 7, 8, 9}, keys)
+
+	page, cursor := l.KeysPage("", 9)
+	require.Len(t, page, 9)
+	require.Equal(t, "", cursor)
+
+	page, cursor = l.KeysPage("bogus", 4)
+	require.Nil(t, page)
+	require.Equal(t, "", cursor)
+
+	// removed entries do not pile up in the index
+	for i := 10; i < 1000; i++ {
+		l.Set(i, i)
+		l.Del(i)
+	}
+	require.True(t, len(l.(*cache).order) <= 2*l.Len()+1)
+
+	page, cursor = l.KeysPage("", 100)
+	require.Equal(t, []interface{}{0, 1, 2, 4, 5, 6, 7, 8, 9}, page)
+	require.Equal(t, "", cursor)
+}
+
+func TestName(t *testing.T) {
+	requireTimers(t)
+
+	profiles := make(chan string, 1)
+	l := New(1, WithName("test"), WithTTL(10*time.Millisecond))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, 1, WithExpireCallback(func(key, value interface{}) {
+		var buf bytes.Buffer
+		_ = pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		profiles <- buf.String()
+	})))
+
+	require.Contains(t, <-profiles, `labels: {"ttlru.cache":"test", "ttlru.task":"expire"}`)
+}
+
+func TestPauseResume(t *testing.T) {
+	requireTimers(t)
+
+	l := New(2, WithTTL(50*time.Millisecond))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, 1))
+	l.Pause()
+	l.Pause()
+	require.False(t, l.Set(2, 2))
+
+	time.Sleep(100 * time.Millisecond)
+
+	// nothing expires while paused
+	_, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 2, l.Len())
+
+	l.Resume()
+	l.Resume()
+
+	// both items still have (almost) their whole ttl left
+	time.Sleep(25 * time.Millisecond)
+	require.Equal(t, 2, l.Len())
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 0, l.Len())
+}
+
+func TestAcquire(t *testing.T) {
+	requireTimers(t)
+
+	l := New(1, WithTTL(50*time.Millisecond))
+	require.NotNil(t, l)
+
+	_, release, ok := l.Acquire(1)
+	require.False(t, ok)
+	require.Nil(t, release)
+
+	require.False(t, l.Set(1, 1))
+	v, release, ok := l.Acquire(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	// leased items are not evicted, the cache holds more than its capacity
+	// until the lease is released
+	require.False(t, l.Set(2, 2))
+	require.Equal(t, 2, l.Len())
+
+	// nor expired
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, l.Len())
+	_, ok = l.Get(1)
+	require.False(t, ok)
+
+	release()
+	release()
+	require.Equal(t, 0, l.Len())
+
+	// releasing a lease on an item that is over capacity evicts it
+	require.False(t, l.Set(1, 1))
+	_, release, ok = l.Acquire(1)
+	require.True(t, ok)
+	require.False(t, l.Set(2, 2))
+	release()
+	require.Equal(t, 1, l.Len())
+	_, ok = l.Get(2)
+	require.True(t, ok)
+}
+
+func TestDestructor(t *testing.T) {
+	var destroyed []interface{}
+	l := New(2, WithTTL(time.Hour), WithDestructor(func(key, value interface{}) {
+		destroyed = append(destroyed, value)
+	}))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "a"))
+	_, release, ok := l.Acquire(1)
+	require.True(t, ok)
+
+	// replacing a leased value defers destroying it
+	require.False(t, l.Set(1, "b"))
+	require.Empty(t, destroyed)
+	release()
+	require.Equal(t, []interface{}{"a"}, destroyed)
+
+	// setting the same value again does not destroy it
+	require.False(t, l.Set(1, "b"))
+	require.Equal(t, []interface{}{"a"}, destroyed)
+
+	require.True(t, l.Del(1))
+	require.Equal(t, []interface{}{"a", "b"}, destroyed)
+
+	require.False(t, l.Set(2, []byte("c")))
+	require.False(t, l.Set(2, []byte("d")))
+	require.Equal(t, []interface{}{"a", "b", []byte("c")}, destroyed)
+
+	l.Purge()
+	require.Equal(t, []interface{}{"a", "b", []byte("c"), []byte("d")}, destroyed)
+}
+
+func TestConfigure(t *testing.T) {
+	requireTimers(t)
+
+	l := New(10, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "aaaa"))
+	require.False(t, l.Set(2, "bbbb"))
+
+	// invalid options leave the cache unchanged
+	require.EqualError(t, l.Configure(WithTTL(time.Minute), WithTTL(-1)), "ttlru: negative ttl -1ns")
+	require.EqualError(t, l.Configure(WithOplog(1)), "ttlru: WithOplog can not be changed after the cache is created")
+	require.EqualError(t, l.Configure(WithCostFunc(func(key, value interface{}) int64 { return 1 })), "ttlru: WithCostFunc requires WithMaxCost")
+	require.Equal(t, time.Hour, l.(*cache).ttl)
+
+	// a smaller budget evicts right away
+	require.NoError(t, l.Configure(WithMaxCost(4), WithCostFunc(func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	})))
+	require.Equal(t, 1, l.Len())
+	_, ok := l.Get(2)
+	require.True(t, ok)
+
+	// a new ttl applies to items as they are set
+	require.NoError(t, l.Configure(WithTTL(20*time.Millisecond)))
+	require.False(t, l.Set(2, "b"))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 0, l.Len())
+}
+
+func TestWatchConfig(t *testing.T) {
+	l := New(3, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	for i := 0; i < 3; i++ {
+		require.False(t, l.Set(i, i))
+	}
+
+	configs := make(chan Config)
+	events := make(chan ConfigEvent)
+	done := make(chan error)
+
+	go func() {
+		done <- WatchConfig(context.Background(), l, configs, func(ev ConfigEvent) {
+			events <- ev
+		})
+	}()
+
+	configs <- Config{TTL: time.Minute, Cap: 1, NoReset: true}
+	ev := <-events
+	require.NoError(t, ev.Err)
+	require.Equal(t, []interface{}{0, 1}, entryKeys(ev.Evicted))
+	require.Equal(t, 1, l.Cap())
+	require.True(t, l.(*cache).NoReset)
+
+	configs <- Config{TTL: -1}
+	ev = <-events
+	require.Error(t, ev.Err)
+	require.Equal(t, time.Minute, l.(*cache).ttl)
+
+	close(configs)
+	require.NoError(t, <-done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, WatchConfig(ctx, l, nil, nil))
+}
+
+func TestApplyLastWriteWins(t *testing.T) {
+	a := New(10, WithTTL(time.Hour), WithLastWriteWins(), WithOplog(10))
+	b := New(10, WithTTL(time.Hour), WithLastWriteWins(), WithOplog(10))
+	require.NotNil(t, a)
+	require.NotNil(t, b)
+
+	require.False(t, a.Set(1, "a1"))
+	require.False(t, b.Set(1, "b1"))
+	require.False(t, a.Set(2, "a2"))
+	require.True(t, b.Del(1))
+	require.False(t, b.Set(3, "b3"))
+
+	drain := func(l Cache) []Op {
+		var ops []Op
+		for len(l.Oplog()) > 0 {
+			ops = append(ops, <-l.Oplog())
+		}
+		return ops
+	}
+
+	aops, bops := drain(a), drain(b)
+
+	// deliver the ops in reverse, stale ops must lose
+	for i := len(bops) - 1; i >= 0; i-- {
+		a.Apply(bops[i])
+	}
+	for i := len(aops) - 1; i >= 0; i-- {
+		b.Apply(aops[i])
+	}
+
+	require.Empty(t, drain(a))
+	require.Empty(t, drain(b))
+
+	for _, k := range []interface{}{1, 2, 3} {
+		av, aok := a.Get(k)
+		bv, bok := b.Get(k)
+		require.Equal(t, aok, bok, "key %v", k)
+		require.Equal(t, av, bv, "key %v", k)
+	}
+
+	// SetIfNewer loses to a later delete, as it would on a replica
+	before := time.Now()
+	require.False(t, a.Set(4, "a4"))
+	require.True(t, a.Del(4))
+	require.False(t, a.SetIfNewer(4, "old", before))
+	require.False(t, a.Contains(4))
+
+	require.True(t, a.SetIfNewer(4, "new", time.Now().Add(time.Minute)))
+	require.NotContains(t, a.(*cache).tombstones, 4)
+	for _, op := range drain(a) {
+		b.Apply(op)
+	}
+	v, ok := b.Get(4)
+	require.True(t, ok)
+	require.Equal(t, "new", v)
+}
+
+func TestApplyMergeFunc(t *testing.T) {
+	l := New(10, WithMergeFunc(func(key, local, remote interface{}) interface{} {
+		return local.(int) + remote.(int)
+	}))
+	require.NotNil(t, l)
+
+	require.True(t, l.Apply(Op{Kind: OpSet, Key: 1, Value: 1}))
+	require.True(t, l.Apply(Op{Kind: OpSet, Key: 1, Value: 2}))
+	v, _ := l.Get(1)
+	require.Equal(t, 3, v)
+
+	require.True(t, l.Apply(Op{Kind: OpDel, Key: 1}))
+	require.False(t, l.Apply(Op{Kind: OpDel, Key: 1}))
+	require.Equal(t, 0, l.Len())
+}
+
+func TestAppendKeys(t *testing.T) {
+	l := New(4, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	for i := 0; i < 4; i++ {
+		require.False(t, l.Set(i, i*10))
+	}
+
+	buf := make([]interface{}, 0, 4)
+	allocs := testing.AllocsPerRun(10, func() {
+		buf = l.AppendKeys(buf[:0])
+	})
+	require.Equal(t, float64(0), allocs)
+	require.ElementsMatch(t, []interface{}{0, 1, 2, 3}, buf)
+
+	require.ElementsMatch(t, []interface{}{0, 10, 20, 30}, l.AppendValues(nil))
+
+	entries := l.AppendEntries([]Entry{{Key: "existing"}})
+	require.Len(t, entries, 5)
+	require.Equal(t, "existing", entries[0].Key)
+
+	l = New(4, WithTTL(time.Hour), WithKeyOrder(InsertionOrder))
+	require.NotNil(t, l)
+	for i := 0; i < 4; i++ {
+		require.False(t, l.Set(i, i*10))
+	}
+	require.Equal(t, []interface{}{-1, 0, 1, 2, 3}, l.AppendKeys([]interface{}{-1}))
+	require.Equal(t, []interface{}{0, 10, 20, 30}, l.AppendValues(nil))
+}
+
+func TestGetNoReset(t *testing.T) {
+	l := New(1, WithTTL(100*time.Millisecond))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, 1))
+	time.Sleep(60 * time.Millisecond)
+
+	v, ok := l.GetNoReset(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	time.Sleep(60 * time.Millisecond)
+	_, ok = l.GetNoReset(1)
+	require.False(t, ok)
+}
+
+func TestWithLockedValue(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	require.False(t, l.WithLockedValue(1, func(value *interface{}) {
+		t.Fatal("called for a missing key")
+	}))
+
+	type counter struct{ n int }
+	require.False(t, l.Set("ptr", &counter{}))
+	require.False(t, l.Set("int", 0))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.True(t, l.WithLockedValue("ptr", func(value *interface{}) {
+				(*value).(*counter).n++
+			}))
+			require.True(t, l.WithLockedValue("int", func(value *interface{}) {
+				*value = (*value).(int) + 1
+			}))
+		}()
+	}
+	wg.Wait()
+
+	v, _ := l.Get("ptr")
+	require.Equal(t, 50, v.(*counter).n)
+	v, _ = l.Get("int")
+	require.Equal(t, 50, v)
+
+	// the value is not destroyed while fn runs, even if the item is removed
+	var destroyed []interface{}
+	l = New(2, WithTTL(time.Hour), WithDestructor(func(key, value interface{}) {
+		destroyed = append(destroyed, value)
+	}))
+	l.Set(1, "one")
+	require.True(t, l.WithLockedValue(1, func(value *interface{}) {
+		require.True(t, l.Del(1))
+		require.Empty(t, destroyed)
+	}))
+	require.Equal(t, []interface{}{"one"}, destroyed)
+	require.False(t, l.Contains(1))
+}
+
+func TestWarm(t *testing.T) {
+	l := New(3, WithTTL(time.Hour))
+	require.NotNil(t, l)
+	require.False(t, l.Set(0, "existing"))
+
+	var read int
+	src := func(yield func(key, value interface{}) bool) {
+		for i := 0; i < 10; i++ {
+			read++
+			if !yield(i, i) {
+				return
+			}
+		}
+	}
+
+	require.NoError(t, l.Warm(context.Background(), src))
+	require.Equal(t, 3, l.Len())
+	require.Equal(t, 4, read)
+	require.ElementsMatch(t, []interface{}{0, 1, 2}, l.Keys())
+
+	v, ok := l.Get(0)
+	require.True(t, ok)
+	require.Equal(t, 0, v)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.Purge()
+	require.Equal(t, context.Canceled, l.Warm(ctx, src))
+	require.Equal(t, 0, l.Len())
+}
+
+type mapSpill struct {
+	values  map[interface{}]interface{}
+	expires map[interface{}]time.Time
+}
+
+func newMapSpill() *mapSpill {
+	return &mapSpill{
+		values:  map[interface{}]interface{}{},
+		expires: map[interface{}]time.Time{},
+	}
+}
+
+func (s *mapSpill) Put(key, value interface{}, expires time.Time) {
+	s.values[key] = value
+	s.expires[key] = expires
+}
+
+func (s *mapSpill) Get(key interface{}) (interface{}, time.Time, bool) {
+	value, ok := s.values[key]
+	return value, s.expires[key], ok
+}
+
+func (s *mapSpill) Del(key interface{}) {
+	delete(s.values, key)
+	delete(s.expires, key)
+}
+
+func (s *mapSpill) Purge() {
+	s.values = map[interface{}]interface{}{}
+	s.expires = map[interface{}]time.Time{}
+}
+
+func TestSpill(t *testing.T) {
+	s := newMapSpill()
+	l := New(2, WithTTL(time.Hour), WithSpill(s))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	require.False(t, l.Set(2, "two"))
+	require.True(t, l.Set(3, "three"))
+	require.Equal(t, 2, l.Len())
+	require.Equal(t, map[interface{}]interface{}{1: "one"}, s.values)
+
+	// a miss is served from the spill, moving the entry back into the cache
+	// and spilling another in its place
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+	require.Equal(t, 2, l.Len())
+	require.Equal(t, map[interface{}]interface{}{2: "two"}, s.values)
+
+	// setting a spilled key supersedes the spilled value
+	require.True(t, l.Set(2, "TWO"))
+	require.NotContains(t, s.values, 2)
+	v, ok = l.Get(2)
+	require.True(t, ok)
+	require.Equal(t, "TWO", v)
+
+	// deleting a spilled key removes it from the spill
+	require.Len(t, s.values, 1)
+	for key := range s.values {
+		require.False(t, l.Del(key))
+		_, ok = l.Get(key)
+		require.False(t, ok)
+	}
+	require.Empty(t, s.values)
+
+	// expired spilled entries are misses
+	s.Put(4, "four", time.Now().Add(-time.Second))
+	_, ok = l.Get(4)
+	require.False(t, ok)
+	require.Equal(t, 2, l.Len())
+
+	s.Put(5, "five", time.Time{})
+	l.Purge()
+	require.Empty(t, s.values)
+
+	_, err := NewWithError(1, WithSpill(s))
+	require.NoError(t, err)
+	require.Error(t, l.Configure(WithSpill(s)))
+}
+
+func TestTombstones(t *testing.T) {
+	l := New(2, WithTTL(time.Hour), WithTombstones(50*time.Millisecond))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	require.True(t, l.Del(1))
+
+	// writes racing the delete are ignored
+	require.False(t, l.Set(1, "stale"))
+	require.False(t, l.SetIfNewer(1, "stale", time.Now()))
+	_, ok := l.Get(1)
+	require.False(t, ok)
+
+	// other keys are unaffected
+	require.False(t, l.Set(2, "two"))
+	_, ok = l.Get(2)
+	require.True(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, l.Set(1, "fresh"))
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "fresh", v)
+
+	_, err := NewWithError(1, WithTombstones(0))
+	require.Error(t, err)
+}
+
+func TestMaxEntryCost(t *testing.T) {
+	cost := func(key, value interface{}) int64 { return int64(len(value.(string))) }
+	l := New(10, WithMaxCost(10), WithCostFunc(cost), WithMaxEntryCost(4))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	require.False(t, l.Set(2, "two"))
+
+	// oversized values are ignored rather than evicting the others
+	require.False(t, l.Set(3, "three"))
+	require.Equal(t, 2, l.Len())
+
+	_, err := l.TrySet(1, "seven")
+	require.True(t, errors.Is(err, ErrEntryTooCostly))
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+
+	evicted, err := l.TrySet(4, "four")
+	require.NoError(t, err)
+	require.False(t, evicted)
+	require.Equal(t, 3, l.Len())
+
+	_, err = NewWithError(1, WithMaxEntryCost(1))
+	require.Error(t, err)
+}
+
+func TestMeta(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	require.False(t, l.SetWithMeta(1, "one", "primary"))
+	v, meta, ok := l.GetWithMeta(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+	require.Equal(t, "primary", meta)
+
+	e, ok := l.GetEntry(1)
+	require.True(t, ok)
+	require.Equal(t, "primary", e.Meta)
+
+	// a plain Set drops the metadata
+	require.False(t, l.Set(1, "uno"))
+	v, meta, ok = l.GetWithMeta(1)
+	require.True(t, ok)
+	require.Equal(t, "uno", v)
+	require.Nil(t, meta)
+
+	_, _, ok = l.GetWithMeta(2)
+	require.False(t, ok)
+}
+
+func TestGetFresh(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	time.Sleep(20 * time.Millisecond)
+
+	v, ok := l.GetFresh(1, time.Second)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+
+	_, ok = l.GetFresh(1, 10*time.Millisecond)
+	require.False(t, ok)
+
+	// setting the value again refreshes it
+	require.False(t, l.Set(1, "uno"))
+	v, ok = l.GetFresh(1, 10*time.Millisecond)
+	require.True(t, ok)
+	require.Equal(t, "uno", v)
+
+	_, ok = l.GetFresh(2, time.Second)
+	require.False(t, ok)
+}
+
+func TestStats(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+	require.Equal(t, Stats{}, l.Stats())
+
+	for i := 0; i < 4; i++ {
+		l.Set(i, i)
+	}
+	l.Set(3, 3)
+
+	s := l.Stats()
+	require.Equal(t, uint64(5), s.Sets)
+	require.Equal(t, uint64(2), s.Evictions)
+	require.Equal(t, float64(400), s.EvictionsPerThousandSets)
+	require.InDelta(t, 2, s.EvictionRate, 0.01)
+	require.NotZero(t, s.OldestAge)
+}
+
+func TestOldestAgeAlert(t *testing.T) {
+	requireTimers(t)
+
+	ages := make(chan time.Duration, 10)
+	l := New(2, WithTTL(time.Hour), WithOldestAgeAlert(30*time.Millisecond, 10*time.Millisecond, func(age time.Duration) {
+		ages <- age
+	}))
+	require.NotNil(t, l)
+	defer l.Close()
+
+	l.Set(1, 1)
+	time.Sleep(20 * time.Millisecond)
+	require.Len(t, ages, 0)
+	require.True(t, l.Stats().OldestAge >= 20*time.Millisecond)
+
+	// the alert fires once, until the oldest item is replaced
+	require.True(t, <-ages > 30*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	require.Len(t, ages, 0)
+
+	l.Del(1)
+	l.Set(2, 2)
+	require.True(t, <-ages > 30*time.Millisecond)
+
+	_, err := NewScopedWithError(1, nil, WithOldestAgeAlert(time.Second, time.Second, func(time.Duration) {}))
+	require.Error(t, err)
+}
+
+func TestShutdown(t *testing.T) {
+	s := newMapSpill()
+	l := New(1, WithTTL(time.Hour), WithSpill(s))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	require.True(t, l.Set(2, "two"))
+	require.NoError(t, l.Shutdown(context.Background()))
+	require.Equal(t, map[interface{}]interface{}{1: "one"}, s.values)
+
+	// new values are refused, while existing ones remain readable
+	_, err := l.TrySet(3, "three")
+	require.Equal(t, ErrShutdown, err)
+	require.False(t, l.SetIfNewer(3, "three", time.Now()))
+	require.False(t, l.Apply(Op{Kind: OpSet, Key: 3, Value: "three"}))
+	v, ok := l.Get(2)
+	require.True(t, ok)
+	require.Equal(t, "two", v)
+
+	// spilled values are served without being moved back
+	v, ok = l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+	require.Equal(t, []interface{}{2}, l.Keys())
+
+	require.True(t, l.Del(2))
+	require.Equal(t, 0, l.Len())
+}
+
+func TestReadOnly(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+	require.False(t, l.Set(1, "one"))
+
+	r := l.ReadOnly()
+	require.Equal(t, r, r.ReadOnly())
+
+	v, ok := r.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+	require.Equal(t, []interface{}{1}, r.Keys())
+
+	require.False(t, r.Set(2, "two"))
+	_, err := r.TrySet(2, "two")
+	require.Equal(t, ErrReadOnly, err)
+	require.False(t, r.Del(1))
+	r.Purge()
+	require.True(t, r.WithLockedValue(1, func(value *interface{}) {
+		*value = "uno"
+	}))
+	require.Equal(t, ErrReadOnly, r.Configure(WithCap(1)))
+	require.Equal(t, ErrReadOnly, r.Shutdown(context.Background()))
+
+	// leasing would keep the entry from being evicted
+	_, release, ok := r.Acquire(1)
+	require.False(t, ok)
+	require.Nil(t, release)
+
+	// reads through the view do not use up items
+	require.False(t, l.Set("tok", "secret", WithMaxUses(1)))
+	_, ok = r.Get("tok")
+	require.False(t, ok)
+	_, _, ok = r.GetWithExpiration("tok")
+	require.False(t, ok)
+	require.False(t, r.Lookup([]interface{}{"tok"})[0].Found)
+	require.False(t, r.WithLockedValue("tok", func(*interface{}) {}))
+	v, ok = l.Get("tok")
+	require.True(t, ok)
+	require.Equal(t, "secret", v)
+
+	require.Equal(t, 1, l.Len())
+	v, ok = l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+}
+
+func TestExpirySpread(t *testing.T) {
+	requireTimers(t)
+
+	l := New(100, WithTTL(10*time.Millisecond), WithExpirySpread(200*time.Millisecond), WithExpiredChannel(100))
+	require.NotNil(t, l)
+
+	for i := 0; i < 100; i++ {
+		l.Set(i, i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// the entries are expired, but not all have been removed yet
+	require.Empty(t, l.Keys())
+	_, ok := l.Get(0)
+	require.False(t, ok)
+	require.NotZero(t, l.Len())
+	require.NotEqual(t, 100, len(l.Expired()))
+
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, 0, l.Len())
+	require.Len(t, l.Expired(), 100)
+}
+
+func TestScoped(t *testing.T) {
+	parent := New(2, WithTTL(time.Hour))
+	require.NotNil(t, parent)
+	require.False(t, parent.Set("shared", "parent"))
+
+	var expired []interface{}
+	l := NewScoped(2, parent, WithTTL(20*time.Millisecond))
+	require.NotNil(t, l)
+
+	cb := WithExpireCallback(func(key, value interface{}) {
+		expired = append(expired, key)
+	})
+	require.False(t, l.Set(1, "one", cb))
+	require.False(t, l.Set(2, "two", cb))
+
+	// no timers are armed
+	require.Nil(t, l.(*cache).items[1].timer)
+
+	v, ok := l.Get("shared")
+	require.True(t, ok)
+	require.Equal(t, "parent", v)
+	require.Equal(t, 2, l.Len())
+
+	time.Sleep(30 * time.Millisecond)
+
+	// expired entries are misses, and are removed by the next Set
+	_, ok = l.Get(1)
+	require.False(t, ok)
+	require.Equal(t, 2, l.Len())
+	require.Empty(t, expired)
+
+	require.False(t, l.Set(3, "three"))
+	require.Equal(t, []interface{}{3}, l.Keys())
+	require.Equal(t, 1, l.Len())
+	require.ElementsMatch(t, []interface{}{1, 2}, expired)
+
+	_, err := NewScopedWithError(1, nil, WithMemoryLimitShedding(0.9, 0.1, time.Second))
+	require.Error(t, err)
+}
+
+func TestStringSet(t *testing.T) {
+	s := NewStringSet(2, 50*time.Millisecond)
+	require.NotNil(t, s)
+	require.Nil(t, NewStringSet(0, time.Second))
+
+	require.True(t, s.Add("a"))
+	require.False(t, s.Add("a"))
+	require.True(t, s.Has("a"))
+	require.False(t, s.Has("b"))
+
+	require.True(t, s.Add("b"))
+	require.True(t, s.Add("c"))
+	require.Equal(t, 2, s.Len())
+	require.False(t, s.Has("a"))
+
+	require.True(t, s.Remove("b"))
+	require.False(t, s.Remove("b"))
+
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, s.Has("c"))
+	require.True(t, s.Add("c"))
+}
+
+func TestStringSetSeen(t *testing.T) {
+	s := NewStringSet(2, 50*time.Millisecond)
+	require.NotNil(t, s)
+
+	start := time.Now()
+	times, first := s.Seen("a")
+	require.Equal(t, 1, times)
+	require.False(t, first.Before(start))
+
+	time.Sleep(10 * time.Millisecond)
+	require.False(t, s.Add("a"))
+	times, again := s.Seen("a")
+	require.Equal(t, 3, times)
+	require.Equal(t, first, again)
+
+	// the count starts over once the string leaves the set
+	time.Sleep(60 * time.Millisecond)
+	times, again = s.Seen("a")
+	require.Equal(t, 1, times)
+	require.True(t, again.After(first))
+}
+
+func TestMaxUses(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set("token", "secret", WithMaxUses(1)))
+	v, ok := l.Get("token")
+	require.True(t, ok)
+	require.Equal(t, "secret", v)
+	_, ok = l.Get("token")
+	require.False(t, ok)
+	require.Equal(t, 0, l.Len())
+
+	// replicas delete the item once it is used up
+	l = New(2, WithTTL(time.Hour), WithOplog(2))
+	replica := New(2, WithTTL(time.Hour))
+	require.False(t, l.Set("token", "secret", WithMaxUses(1)))
+	_, ok = l.Get("token")
+	require.True(t, ok)
+	require.True(t, replica.Apply(<-l.Oplog()))
+	del := <-l.Oplog()
+	require.Equal(t, Op{Kind: OpDel, Key: "token"}, del)
+	require.True(t, replica.Apply(del))
+	_, ok = replica.Get("token")
+	require.False(t, ok)
+
+	// setting the value again drops the limit
+	require.False(t, l.Set("coupon", 1, WithMaxUses(2)))
+	require.False(t, l.Set("coupon", 2))
+	for i := 0; i < 3; i++ {
+		_, ok = l.GetNoReset("coupon")
+		require.True(t, ok)
+	}
+
+	// concurrent reads never share a use
+	require.False(t, l.Set("coupon", 3, WithMaxUses(10)))
+	var served int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := l.Get("coupon"); ok {
+				atomic.AddInt32(&served, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(10), served)
+
+	// the value of a lease on the last use is only destroyed when released
+	var destroyed []interface{}
+	l = New(2, WithTTL(time.Hour), WithDestructor(func(key, value interface{}) {
+		destroyed = append(destroyed, key)
+	}))
+	require.False(t, l.Set("lease", 1, WithMaxUses(1)))
+	v, release, ok := l.Acquire("lease")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+	require.False(t, l.Contains("lease"))
+	require.Empty(t, destroyed)
+	release()
+	require.Equal(t, []interface{}{"lease"}, destroyed)
+}
+
+func TestSetAt(t *testing.T) {
+	l := New(2, WithTTL(50*time.Millisecond))
+	require.NotNil(t, l)
+
+	require.False(t, l.SetAt(1, "one", time.Now().Add(30*time.Millisecond)))
+	_, ok := l.Get(1)
+	require.False(t, ok)
+	require.Empty(t, l.Keys())
+	require.Equal(t, 1, l.Len())
+
+	// the ttl starts once the item is visible
+	time.Sleep(60 * time.Millisecond)
+	v, ok := l.GetNoReset(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+
+	time.Sleep(30 * time.Millisecond)
+	_, ok = l.Get(1)
+	require.False(t, ok)
+
+	// a time in the past is visible immediately
+	require.False(t, l.SetAt(2, "two", time.Now().Add(-time.Hour)))
+	v, ok = l.Get(2)
+	require.True(t, ok)
+	require.Equal(t, "two", v)
+}
+
+func TestExpiringWithin(t *testing.T) {
+	ttls := map[interface{}]time.Duration{1: time.Minute, 2: time.Second, 3: time.Hour, 4: 0, 5: 2 * time.Second}
+	l := New(10, WithTTLFunc(func(key, value interface{}) time.Duration {
+		return ttls[key]
+	}))
+	require.NotNil(t, l)
+
+	for key := range ttls {
+		l.Set(key, key)
+	}
+
+	require.Equal(t, []interface{}{2, 5}, entryKeys(l.ExpiringWithin(10*time.Second)))
+	require.Equal(t, []interface{}{2, 5, 1}, entryKeys(l.ExpiringWithin(time.Hour-time.Second)))
+	require.Empty(t, l.ExpiringWithin(time.Millisecond))
+}
+
+func TestTimerGranularity(t *testing.T) {
+	requireTimers(t)
+
+	l := New(200, WithTTL(20*time.Millisecond), WithTimerGranularity(50*time.Millisecond))
+	require.NotNil(t, l)
+	c := l.(*cache)
+
+	for i := 0; i < 100; i++ {
+		l.Set(i, i)
+	}
+
+	c.lock.RLock()
+	require.True(t, len(c.ticks) <= 2)
+	require.Nil(t, c.items[0].timer)
+	c.lock.RUnlock()
+
+	// deleted entries leave their tick, which stops once empty
+	for i := 0; i < 100; i++ {
+		require.True(t, l.Del(i))
+	}
+	c.lock.RLock()
+	require.Empty(t, c.ticks)
+	c.lock.RUnlock()
+
+	for i := 0; i < 100; i++ {
+		l.Set(i, i)
+	}
+	time.Sleep(25 * time.Millisecond)
+	require.Empty(t, l.Keys())
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, l.Len())
+	c.lock.RLock()
+	require.Empty(t, c.ticks)
+	c.lock.RUnlock()
+
+	// a tick that fires once replaced by a tick for the same interval leaves
+	// the new one in place
+	stale := &tick{n: 1, entries: map[*entry]struct{}{}}
+	fresh := &tick{n: 1, timer: time.NewTimer(time.Hour), entries: map[*entry]struct{}{}}
+	defer fresh.timer.Stop()
+	c.lock.Lock()
+	c.ticks[1] = fresh
+	c.lock.Unlock()
+	c.fireTick(stale)
+	c.lock.Lock()
+	require.Equal(t, fresh, c.ticks[1])
+	delete(c.ticks, 1)
+	c.lock.Unlock()
+
+	// leased entries the tick could not expire are consistent until released
+	l.Set("lease", 1)
+	_, release, ok := l.Acquire("lease")
+	require.True(t, ok)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, l.ConsistencyReport().Problems)
+	release()
+	require.Equal(t, 0, l.Len())
+}
+
+func TestWallClock(t *testing.T) {
+	// TTLs are measured by the monotonic clock by default, which time.Time
+	// only carries when it is read from time.Now
+	monotonic := func(ts time.Time) bool {
+		return ts != ts.Round(0)
+	}
+
+	l := New(1, WithTTL(time.Hour))
+	require.NotNil(t, l)
+	l.Set(1, 1)
+	require.True(t, monotonic(l.(*cache).items[1].expires))
+
+	l = New(1, WithTTL(time.Hour), WithWallClock())
+	require.NotNil(t, l)
+	l.Set(1, 1)
+	require.False(t, monotonic(l.(*cache).items[1].expires))
+
+	l.Pause()
+	require.False(t, monotonic(l.(*cache).pausedAt))
+	l.Resume()
+	require.False(t, monotonic(l.(*cache).items[1].expires))
+	_, ok := l.Get(1)
+	require.True(t, ok)
+
+	require.Error(t, l.Configure(WithWallClock()))
+}
+
+func TestChecksum(t *testing.T) {
+	l := New(3, WithTTL(time.Hour), WithChecksum())
+	require.NotNil(t, l)
+
+	a, b := []byte("payload"), []byte("payload")
+	require.False(t, l.Set("a", a))
+	require.False(t, l.Set("b", b))
+	require.False(t, l.Set("c", "not checked"))
+
+	v, ok, err := l.TryGet("a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("payload"), v)
+
+	a[0], b[0] = 'P', 'P'
+
+	_, ok, err = l.TryGet("a")
+	require.Equal(t, ErrChecksum, err)
+	require.False(t, ok)
+	_, ok = l.Get("b")
+	require.False(t, ok)
+	require.Equal(t, []interface{}{"c"}, l.Keys())
+
+	// replacing a value takes a new checksum
+	require.False(t, l.Set("b", b))
+	v, ok = l.Get("b")
+	require.True(t, ok)
+	require.Equal(t, []byte("Payload"), v)
+}
+
+func TestLookup(t *testing.T) {
+	l := New(3, WithTTL(time.Hour), WithExpirySpread(time.Hour))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	require.False(t, l.Set(2, "two"))
+
+	// expire 2 without removing it, as its removal is spread
+	c := l.(*cache)
+	c.lock.Lock()
+	c.items[2].expires = time.Now()
+	c.lock.Unlock()
+
+	results := l.Lookup([]interface{}{1, 2, 3})
+	require.Len(t, results, 3)
+
+	require.Equal(t, 1, results[0].Key)
+	require.Equal(t, "one", results[0].Value)
+	require.True(t, results[0].Found)
+	require.False(t, results[0].Stale)
+	require.InDelta(t, time.Hour, results[0].TTL, float64(time.Second))
+
+	require.Equal(t, Result{Key: 2, Value: "two", Stale: true}, results[1])
+	require.Equal(t, Result{Key: 3}, results[2])
+}
+
+func TestRename(t *testing.T) {
+	requireTimers(t)
+
+	l := New(3, WithTTL(50*time.Millisecond), WithKeyOrder(InsertionOrder))
+	require.NotNil(t, l)
+
+	require.False(t, l.Set(1, "one"))
+	require.False(t, l.Set(2, "two"))
+	require.False(t, l.Set(3, "three"))
+	before, _ := l.GetEntry(1)
+
+	require.True(t, l.Rename(1, "canonical"))
+	require.False(t, l.Rename(1, "other"))
+	_, ok := l.GetEntry(1)
+	require.False(t, ok)
+
+	after, ok := l.GetEntry("canonical")
+	require.True(t, ok)
+	require.Equal(t, "one", after.Value)
+	require.Equal(t, before.CreatedAt, after.CreatedAt)
+	require.Equal(t, []interface{}{"canonical", 2, 3}, l.Keys())
+
+	// renaming over an existing key replaces it
+	require.True(t, l.Rename(2, 3))
+	require.Equal(t, []interface{}{"canonical", 3}, l.Keys())
+	v, _ := l.GetNoReset(3)
+	require.Equal(t, "two", v)
+
+	// the original expiration is kept
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, 0, l.Len())
+}
+
+func TestContextCache(t *testing.T) {
+	requireTimers(t)
+
+	_, ok := FromContext(context.Background())
+	require.False(t, ok)
+
+	_, _, err := NewContextCache(context.Background(), 0)
+	require.Error(t, err)
+
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, l, err := NewContextCache(parent, 2, WithTTL(time.Hour))
+	require.NoError(t, err)
+
+	got, ok := FromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, l, got)
+
+	require.False(t, l.Set(1, 1))
+	timer := l.(*cache).items[1].timer
+
+	cancel()
+	<-l.(*cache).done
+	require.Equal(t, 0, l.Len())
+	require.False(t, timer.Stop())
+}
+
+func TestTTLBounds(t *testing.T) {
+	ttls := map[interface{}]time.Duration{1: 0, 2: time.Millisecond, 3: time.Minute, 4: 30 * 24 * time.Hour}
+	l := New(4, WithTTLFunc(func(key, value interface{}) time.Duration {
+		return ttls[key]
+	}), WithTTLBounds(time.Second, time.Hour))
+	require.NotNil(t, l)
+
+	for key := range ttls {
+		l.Set(key, key)
+	}
+
+	c := l.(*cache)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	require.Equal(t, time.Hour, c.items[1].ttl)
+	require.Equal(t, time.Second, c.items[2].ttl)
+	require.Equal(t, time.Minute, c.items[3].ttl)
+	require.Equal(t, time.Hour, c.items[4].ttl)
+
+	_, err := NewWithError(1, WithTTLBounds(0, time.Hour))
+	require.Error(t, err)
+	_, err = NewWithError(1, WithTTLBounds(time.Hour, time.Second))
+	require.Error(t, err)
+}
+
+func TestConsistencyReport(t *testing.T) {
+	requireTimers(t)
+
+	l := New(3, WithTTL(time.Hour), WithProtectedSegment(1, 1))
+	require.NotNil(t, l)
+
+	l.Set(1, 1)
+	l.Set(2, 2)
+	l.Set(3, 3)
+	l.Get(1)
+	l.Get(1)
+
+	require.Equal(t, 3, l.HeapDepth())
+	require.Equal(t, 3, l.MapLen())
+	require.Equal(t, Consistency{MapLen: 3, HeapLen: 3, Timers: 3}, l.ConsistencyReport())
+
+	// a leak from the heap is reported
+	c := l.(*cache)
+	c.lock.Lock()
+	heap.Remove(c.heap, c.items[2].index)
+	c.lock.Unlock()
+
+	r := l.ConsistencyReport()
+	require.Equal(t, 2, r.HeapLen)
+	require.NotEmpty(t, r.Problems)
+}
+
+func TestWithoutTimers(t *testing.T) {
+	require.Equal(t, !notimers, TimersSupported)
+	require.True(t, MemoryLimitSheddingSupported)
+
+	var expired []interface{}
+	l := New(2, WithTTL(10*time.Millisecond), WithoutTimers(), WithOnEvictBatch(func(entries []Entry) {
+		expired = append(expired, entryKeys(entries)...)
+	}))
+	require.NotNil(t, l)
+
+	l.Set(1, 1)
+	require.Equal(t, Consistency{MapLen: 1, HeapLen: 1}, l.ConsistencyReport())
+
+	// callbacks run during the call that removes the items
+	time.Sleep(20 * time.Millisecond)
+	l.Set(2, 2)
+	require.Equal(t, []interface{}{1}, expired)
+
+	// entries that never expire do not hold up the others
+	l = New(4, WithTTL(10*time.Millisecond), WithoutTimers(), WithExpiredChannel(4))
+	l.SetWithTTL("forever", 0, 0)
+	l.Set(1, 1)
+	l.Set(2, 2)
+	time.Sleep(20 * time.Millisecond)
+	l.Set(3, 3)
+	require.Equal(t, 2, l.Len())
+	require.Len(t, l.Expired(), 2)
+	require.Equal(t, 1, (<-l.Expired()).Key)
+	require.Equal(t, 2, (<-l.Expired()).Key)
+
+	_, _, err := NewContextCache(context.Background(), 1, WithoutTimers())
+	require.Error(t, err)
+	require.Error(t, l.Configure(WithoutTimers()))
+}
+
+func TestLoadCooldown(t *testing.T) {
+	_, err := NewWithError(2, WithLoadCooldown(0))
+	require.Error(t, err)
+
+	c := New(2, WithTTL(time.Hour), WithLoadCooldown(50*time.Millisecond))
+
+	var calls int32
+	fn := Memoize(c, func(key interface{}) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	})
+
+	v, err := fn(1)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), v)
+
+	// the first load after a delete reaches the backend
+	require.True(t, c.Del(1))
+	v, err = fn(1)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), v)
+
+	// later ones within the cooldown get its result
+	require.True(t, c.Del(1))
+	v, err = fn(1)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), v)
+	v, err = fn(1)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), v)
+
+	// until the cooldown is over
+	time.Sleep(60 * time.Millisecond)
+	v, err = fn(1)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), v)
+
+	// keys that were not deleted load as usual
+	v, err = fn(2)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), v)
+}
+
+func TestValueTransform(t *testing.T) {
+	encode := func(value interface{}) (interface{}, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		return "enc:" + s, nil
+	}
+	decode := func(value interface{}) (interface{}, error) {
+		s := value.(string)
+		if !strings.HasPrefix(s, "enc:") {
+			return nil, errors.New("not encoded")
+		}
+		return strings.TrimPrefix(s, "enc:"), nil
+	}
+
+	var destroyed []interface{}
+	l := New(3, WithTTL(time.Hour), WithValueTransform(encode, decode),
+		WithDestructor(func(key, value interface{}) {
+			destroyed = append(destroyed, value)
+		}))
+	c := l.(*cache)
+
+	require.False(t, l.Set(1, "one"))
+	require.Equal(t, "enc:one", c.items[1].value)
+
+	v, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+	require.Equal(t, []interface{}{"one"}, l.AppendValues(nil))
+	require.Equal(t, "one", l.Entries()[0].Value)
+
+	// values that fail to encode are not set
+	_, err := l.TrySet(2, 2)
+	require.EqualError(t, err, "not a string")
+	_, ok = l.Get(2)
+	require.False(t, ok)
+
+	require.True(t, l.WithLockedValue(1, func(value *interface{}) {
+		*value = (*value).(string) + "!"
+	}))
+	require.Equal(t, "enc:one!", c.items[1].value)
+
+	require.True(t, l.SetIfNewer(4, "four", time.Now()))
+	require.Equal(t, "enc:four", c.items[4].value)
+	v, ok = l.Get(4)
+	require.True(t, ok)
+	require.Equal(t, "four", v)
+	require.False(t, l.SetIfNewer(5, 5, time.Now()))
+	require.True(t, l.Del(4))
+
+	// values that fail to decode read as misses
+	c.items[1].value = "plain"
+	_, ok = l.Get(1)
+	require.False(t, ok)
+	_, _, err = l.TryGet(1)
+	require.EqualError(t, err, "not encoded")
+	require.Empty(t, l.AppendValues(nil))
+
+	require.False(t, l.Set(3, "three"))
+	require.True(t, l.Del(3))
+	require.Equal(t, []interface{}{"one", "four", "three"}, destroyed)
+
+	// the ttl function is given the plain value
+	ttl := func(key, value interface{}) time.Duration {
+		d, _ := time.ParseDuration(value.(string))
+		return d
+	}
+	l = New(3, WithTTL(time.Hour), WithTTLFunc(ttl), WithValueTransform(encode, decode), WithOplog(1))
+	require.False(t, l.Set(1, "1m"))
+	require.True(t, l.SetIfNewer(2, "2m", time.Now()))
+	require.Equal(t, time.Minute, l.(*cache).items[1].ttl)
+	require.Equal(t, 2*time.Minute, l.(*cache).items[2].ttl)
+
+	r := New(3, WithTTL(time.Hour), WithTTLFunc(ttl), WithValueTransform(encode, decode))
+	require.True(t, r.Apply(<-l.Oplog()))
+	require.Equal(t, time.Minute, r.(*cache).items[1].ttl)
+}
+
+func TestStatsCost(t *testing.T) {
+	l := New(100, WithMaxCost(math.MaxInt64), WithCostFunc(func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}))
+
+	require.Zero(t, l.Stats().CostP50)
+
+	for i := 0; i < 89; i++ {
+		l.Set(i, "x")
+	}
+	for i := 89; i < 98; i++ {
+		l.Set(i, strings.Repeat("x", 100))
+	}
+	l.Set(98, strings.Repeat("x", 5000))
+	l.Set(99, strings.Repeat("x", 5000))
+
+	s := l.Stats()
+	require.Equal(t, int64(1), s.CostP50)
+	require.Equal(t, int64(127), s.CostP90)
+	require.Equal(t, int64(8191), s.CostP99)
+
+	// removed and replaced items no longer count
+	l.Del(98)
+	l.Set(99, "x")
+	require.Equal(t, int64(127), l.Stats().CostP99)
+
+	l.Purge()
+	require.Zero(t, l.Stats().CostP99)
+}
+
+func TestSampledTrace(t *testing.T) {
+	_, err := NewWithError(2, WithSampledTrace(0, func(TraceEvent) {}))
+	require.Error(t, err)
+
+	var events []TraceEvent
+	var l Cache
+	l = New(2, WithTTL(time.Hour), WithSampledTrace(1, func(ev TraceEvent) {
+		// the cache is not locked while tracing
+		l.Len()
+		events = append(events, ev)
+	}))
+
+	l.Set(1, 1)
+	l.Get(1)
+	l.Get(2)
+	l.Del(1)
+
+	require.Len(t, events, 4)
+	for i, outcome := range []TraceOutcome{TraceSet, TraceHit, TraceMiss, TraceDel} {
+		require.Equal(t, outcome, events[i].Outcome)
+		require.True(t, events[i].Latency > 0)
+	}
+	require.Equal(t, 1, events[0].Key)
+	require.InDelta(t, time.Hour, events[1].TTL, float64(time.Minute))
+	require.Zero(t, events[2].TTL)
+	require.Zero(t, events[3].TTL)
+
+	// only a fraction of operations is sampled
+	var sampled int
+	l = New(2, WithSampledTrace(0.1, func(TraceEvent) { sampled++ }))
+	for i := 0; i < 1000; i++ {
+		l.Get(i)
+	}
+	require.InDelta(t, 100, sampled, 50)
+}
+
+func TestPeek(t *testing.T) {
+	l := New(2, WithTTL(50*time.Millisecond))
+
+	l.Set(1, 1)
+	l.Set(2, 2)
+	accessed := l.(*cache).items[1].accessed
+
+	time.Sleep(30 * time.Millisecond)
+	v, ok := l.Peek(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+	require.Equal(t, accessed, l.(*cache).items[1].accessed)
+
+	// peeking is not an access, so 1 still expires, and is evicted, first
+	l.Set(3, 3)
+	_, ok = l.Peek(1)
+	require.False(t, ok)
+
+	// nor does it reset the ttl
+	time.Sleep(30 * time.Millisecond)
+	_, ok = l.Peek(2)
+	require.False(t, ok)
+
+	_, ok = l.Peek(4)
+	require.False(t, ok)
+}
+
+func TestContains(t *testing.T) {
+	l := New(2, WithTTL(50*time.Millisecond))
+
+	l.Set(1, 1)
+	require.True(t, l.Contains(1))
+	require.False(t, l.Contains(2))
+
+	// it does not reset the ttl
+	time.Sleep(30 * time.Millisecond)
+	require.True(t, l.Contains(1))
+	time.Sleep(30 * time.Millisecond)
+	require.False(t, l.Contains(1))
+
+	// nor does it fall back to the parent of a scope
+	parent := New(2)
+	parent.Set(3, 3)
+	require.False(t, NewScoped(2, parent).Contains(3))
+}
+
+func TestDelGet(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+
+	l.Set(1, "one")
+	v, ok := l.DelGet(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+	require.False(t, l.Contains(1))
+
+	v, ok = l.DelGet(1)
+	require.False(t, ok)
+	require.Nil(t, v)
+}
+
+func TestMove(t *testing.T) {
+	var destroyed []interface{}
+	hot := New(2, WithTTL(time.Hour), WithDestructor(func(key, value interface{}) {
+		destroyed = append(destroyed, key)
+	}))
+	warm := New(4, WithTTL(time.Minute))
+
+	hot.Set(1, "one")
+	expires := hot.(*cache).items[1].expires
+
+	require.True(t, hot.Move(1, warm))
+	require.False(t, hot.Contains(1))
+	v, ok := warm.Peek(1)
+	require.True(t, ok)
+	require.Equal(t, "one", v)
+
+	// the remaining ttl, rather than that of dst, is kept
+	require.Equal(t, expires, warm.(*cache).items[1].expires)
+
+	// the value was moved, not dropped
+	require.Empty(t, destroyed)
+
+	require.False(t, hot.Move(1, warm))
+	require.False(t, warm.Move(1, warm.ReadOnly()))
+
+	// moves in both directions at once do not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			warm.Move(1, hot)
+		}()
+		go func() {
+			defer wg.Done()
+			hot.Move(1, warm)
+		}()
+	}
+	wg.Wait()
+	require.True(t, hot.Contains(1) != warm.Contains(1))
+	require.Empty(t, destroyed)
+}
+
+func TestGetWithExpiration(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+
+	l.Set(1, 1)
+	v, expires, ok := l.GetWithExpiration(1)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+	require.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Second)
+
+	_, expires, ok = l.GetWithExpiration(2)
+	require.False(t, ok)
+	require.True(t, expires.IsZero())
+
+	// items that never expire have no expiration
+	l = New(2)
+	l.Set(1, 1)
+	_, expires, ok = l.GetWithExpiration(1)
+	require.True(t, ok)
+	require.True(t, expires.IsZero())
+}
+
+func TestMinResidency(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+
+	l.Set(1, 1, WithMinResidency(50*time.Millisecond))
+	l.Set(2, 2)
+
+	// 1 expires first, but is not yet evictable
+	require.True(t, l.Set(3, 3))
+	require.True(t, l.Contains(1))
+	require.False(t, l.Contains(2))
+
+	// once resident long enough it is evicted as usual
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, l.Set(4, 4))
+	require.False(t, l.Contains(1))
+
+	// every entry resident, the cache grows rather than evict
+	l = New(1, WithTTL(time.Hour))
+	l.Set(1, 1, WithMinResidency(time.Hour))
+	require.False(t, l.Set(2, 2, WithMinResidency(time.Hour)))
+	require.Equal(t, 2, l.Len())
+
+	// but no further than twice its capacity
+	require.True(t, l.Set(3, 3, WithMinResidency(time.Hour)))
+	require.Equal(t, 2, l.Len())
+	require.False(t, l.Contains(1))
+}
+
+func TestSetWithTTL(t *testing.T) {
+	l := New(3, WithTTL(time.Hour), WithTTLBounds(time.Millisecond, 2*time.Hour))
+
+	l.SetWithTTL(1, 1, 30*time.Millisecond)
+	l.SetWithTTL(2, 2, 24*time.Hour)
+	l.Set(3, 3)
+
+	// the bounds still apply
+	require.Equal(t, 2*time.Hour, ttlOf(l, 2))
+
+	// resetting the ttl on access keeps the override
+	_, ok := l.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 30*time.Millisecond, ttlOf(l, 1))
+
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, l.Contains(1))
+	require.True(t, l.Contains(3))
+
+	// setting again without an override restores the cache ttl
+	l.SetWithTTL(3, 3, time.Minute)
+	l.Set(3, 3)
+	require.Equal(t, time.Hour, ttlOf(l, 3))
+}
+
+// ttlOf returns the ttl of key, which may be expiring at the same time
+func ttlOf(l Cache, key interface{}) time.Duration {
+	c := l.(*cache)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if ent, ok := c.items[key]; ok {
+		return ent.ttl
+	}
+	return -1
+}
+
+func TestNeverExpires(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+
+	// entries that never expire are evicted after those that do
+	l.SetWithTTL("forever", 1, 0)
+	l.Set("hour", 2)
+	require.True(t, l.Set("new", 3))
+	require.True(t, l.Contains("forever"))
+	require.False(t, l.Contains("hour"))
+
+	// and among themselves, the oldest first
+	l.SetWithTTL("later", 4, 0)
+	require.True(t, l.Set("newer", 5))
+	require.False(t, l.Contains("forever"))
+	require.True(t, l.Contains("later"))
+}
+
+func TestLowPriorityInsert(t *testing.T) {
+	l := New(3, WithTTL(time.Hour))
+
+	l.Set(1, 1)
+	l.Set(2, 2)
+
+	// scanned entries are evicted first, even though the working set
+	// expires sooner
+	l.Set(3, 3, WithLowPriorityInsert())
+	require.True(t, l.Set(4, 4, WithLowPriorityInsert()))
+	require.True(t, l.Contains(1))
+	require.True(t, l.Contains(2))
+	require.False(t, l.Contains(3))
+
+	// until they are read
+	_, ok := l.Get(4)
+	require.True(t, ok)
+	require.True(t, l.Set(5, 5, WithLowPriorityInsert()))
+	require.False(t, l.Contains(1))
+	require.True(t, l.Contains(4))
+
+	require.Empty(t, l.ConsistencyReport().Problems)
+}
+
+func TestStatsRemainingTTL(t *testing.T) {
+	l := New(20)
+
+	require.Equal(t, [11]time.Duration{}, l.Stats().RemainingTTL)
+
+	// items that never expire are left out
+	l.Set(0, 0)
+	for i := 1; i <= 11; i++ {
+		l.SetWithTTL(i, i, time.Duration(i)*time.Hour)
+	}
+
+	d := l.Stats().RemainingTTL
+	for i := range d {
+		require.InDelta(t, time.Duration(i+1)*time.Hour, d[i], float64(time.Second))
+	}
+}
+
+func TestFetch(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+
+	var calls int32
+	release := make(chan struct{})
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "one", nil
+	}
+
+	// concurrent fetches of a missing key share a single load
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := l.Fetch(1, load)
+			require.NoError(t, err)
+			require.Equal(t, "one", v)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// and the result is cached
+	v, err := l.Fetch(1, load)
+	require.NoError(t, err)
+	require.Equal(t, "one", v)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// errors are not
+	_, err = l.Fetch(2, func() (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	require.EqualError(t, err, "failed")
+	require.False(t, l.Contains(2))
+
+	_, err = l.ReadOnly().Fetch(2, load)
+	require.Equal(t, ErrReadOnly, err)
+}
+
+func TestGetWhileConfiguringReset(t *testing.T) {
+	l := New(2, WithTTL(time.Hour))
+	l.Set(1, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, l.Configure(WithoutReset()))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		l.Get(1)
+		l.GetNoReset(1)
+	}
+	<-done
+}
+
+func TestConfigureWhileInUse(t *testing.T) {
+	l := New(4, WithTTL(time.Hour), WithDestructor(func(key, value interface{}) {}))
+
+	require.Error(t, l.Configure(WithName("name")))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, l.Configure(
+				WithCap(2+i%4),
+				WithLoadCooldown(time.Millisecond),
+				WithOnEvictBatch(func([]Entry) {}),
+				WithDestructor(func(key, value interface{}) {}),
+			))
+		}
+	}()
+
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := g*1000 + i
+				l.Set(key, i)
+				l.Del(key - 1)
+				_, err := l.Fetch(key-1, func() (interface{}, error) {
+					return i, nil
+				})
+				require.NoError(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestTombstoneQueue(t *testing.T) {
+	l := New(2, WithTombstones(time.Nanosecond))
+	c := l.(*cache)
+
+	for i := 0; i < 1000; i++ {
+		l.Set(1, i)
+		l.Del(1)
+		l.Set(i%3+2, i)
+		l.Del(i%3 + 2)
+	}
+
+	require.Len(t, c.tombstones, 2)
+	require.True(t, len(c.tombstoneKeys) <= 2*len(c.tombstones))
+	require.Contains(t, c.tombstoneKeys, 1)
+}
+
+func TestPartitionedRemove(t *testing.T) {
+	parts := make([]Partition, 4)
+	for i := range parts {
+		parts[i] = New(1, WithTTL(time.Hour))
+	}
+	names := []string{"a", "b", "c", "d"}
+
+	require.Nil(t, NewPartitioned(parts, WithPartitionNames("a", "b")))
+	require.Nil(t, NewPartitioned(parts, WithPartitionNames("a", "a", "b", "c")))
+
+	before := NewPartitioned(parts, WithPartitionNames(names...))
+	after := NewPartitioned(parts[1:], WithPartitionNames(names[1:]...))
+
+	// only the keys of the removed partition move
+	for i := 0; i < 10000; i++ {
+		if old := before.Partitions(i)[0]; old != parts[0] {
+			require.True(t, old == after.Partitions(i)[0], "key %d moved", i)
+		}
+	}
+}
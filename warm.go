@@ -0,0 +1,51 @@
+package ttlru
+
+import "context"
+
+// Warm stores the key/value pairs produced by src until it is exhausted, the
+// cache is full or ctx is done. src calls yield for each pair and must stop
+// when yield returns false. Warming never evicts: it stops at the first new key
+// that does not fit, leaving the remainder of src unread. The error is that of
+// ctx if it ended the warm, and nil otherwise.
+func (c *cache) Warm(ctx context.Context, src func(yield func(key, value interface{}) bool)) error {
+	var err error
+
+	src(func(key, value interface{}) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+
+		c.lock.Lock()
+		defer c.unlock()
+
+		plain := value
+		value, verr := c.encodeValue(value)
+		if verr != nil {
+			// like a failed Set, this pair is skipped
+			return true
+		}
+
+		if !c.fits(key, value) {
+			return false
+		}
+
+		c.storeEncoded(Op{Key: key, Value: value}, plain, nil)
+		return true
+	})
+
+	return err
+}
+
+// fits reports whether setting key to value would not evict anything
+func (c *cache) fits(key, value interface{}) bool {
+	cost := c.entryCost(key, value)
+	if e, ok := c.items[key]; ok {
+		return c.maxCost <= 0 || c.cost-e.cost+cost <= c.maxCost
+	}
+
+	if len(c.items) >= c.cap {
+		return false
+	}
+
+	return c.maxCost <= 0 || c.cost+cost <= c.maxCost
+}